@@ -1,10 +1,12 @@
 package turnc
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
-	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -17,18 +19,29 @@ import (
 //
 // Provides transparent net.Conn interfaces to remote peers.
 type Client struct {
-	log         *zap.Logger
-	con         net.Conn
-	conClose    bool
-	stun        STUNClient
-	mux         sync.RWMutex
-	username    stun.Username
-	password    string
-	realm       stun.Realm
-	integrity   stun.MessageIntegrity
-	alloc       *Allocation // the only allocation
-	refreshRate time.Duration
-	done        chan struct{}
+	stats         stats // first for 64-bit alignment of atomic counters
+	log           *zap.Logger
+	connMux       sync.RWMutex
+	con           net.Conn      // protected with connMux
+	conClose      bool          // protected with connMux
+	stun          STUNClient    // protected with connMux
+	done          chan struct{} // protected with connMux
+	manualConn    *manualConn   // protected with connMux, see redirect
+	mux           sync.RWMutex
+	credentials   CredentialProvider
+	tokens        TokenProvider // third-party authorization if not nil
+	userHash      bool
+	alloc         *Allocation // the only allocation
+	refreshRate   time.Duration
+	fixedRate     bool // refresh rate is set explicitly
+	dialData      func() (net.Conn, error)
+	stream        bool // stream framing is forced by Options.Stream
+	stunOptions   []stun.ClientOption
+	customSTUN    bool // STUN client is provided by Options.STUN
+	dialAlternate func(addr, domain string) (net.Conn, error)
+	recover       bool
+	onRecover     func(relayed turn.RelayedAddress)
+	scheduler     *scheduler
 }
 
 // Options contains available config for TURN  client.
@@ -40,20 +53,78 @@ type Options struct {
 	// Long-term integrity.
 	Username string
 	Password string
+	// Credentials provides long-term credentials on each 401
+	// (Unauthorized) response, so they can be changed during session.
+	// Defaults to StaticCredentials with Username and Password.
+	Credentials CredentialProvider
+
+	// UserHash enables sending USERHASH instead of USERNAME for privacy
+	// if server supports username anonymity, RFC 8489 Section 9.2.
+	UserHash bool
+
+	// Tokens enables third-party authorization with OAuth access tokens,
+	// RFC 7635, instead of long-term credentials. Token is requested
+	// from provider on each 401 (Unauthorized) response and before its
+	// expiration.
+	Tokens TokenProvider
 
 	// STUN client options.
 	RTO          time.Duration
 	NoRetransmit bool
 
 	// TURN options.
+	//
+	// By default, refreshes are scheduled by lifetimes granted by server,
+	// and RefreshRate sets fixed rate of refresh requests instead.
 	RefreshRate     time.Duration
 	RefreshDisabled bool
 
+	// Recover enables automatic reallocation when allocation is lost,
+	// i.e. refresh of allocation, permission or channel binding fails with
+	// 437 (Allocation Mismatch), for example after server restart.
+	// Permissions are installed again and channels are rebound for
+	// existing connections, so Allocation, Permission and Connection
+	// values remain usable. OnRecover is called in separate goroutine
+	// with new relayed address after successful recovery. Allocation is
+	// also created again if credentials expire and provider returns new
+	// username, see ErrUsernameChanged.
+	//
+	// Connection to server is not dialed again, so allocation is only
+	// recovered while connection is usable, e.g. over UDP. Over TCP or
+	// TLS, allocation is lost with connection.
+	Recover   bool
+	OnRecover func(relayed turn.RelayedAddress)
+
 	// ConnManualClose disables connection automatic close on Close().
+	// Connections to alternate servers are dialed by client, so they are
+	// closed anyway, and Conn is left open on redirect.
 	ConnManualClose bool
+
+	// Stream enables framing of STUN and ChannelData messages for
+	// stream-oriented connections like TCP (RFC 5766 Section 2.1).
+	// Always enabled for *net.TCPConn and *tls.Conn.
+	Stream bool
+
+	// DialData dials new data connection to the same server for
+	// RFC 6062 TCP relaying. Defaults to TCP connection to remote
+	// address of Conn.
+	DialData func() (net.Conn, error)
+
+	// DialAlternate dials alternate server with addr ("host:port") when
+	// Allocate is redirected by 300 (Try Alternate) response, RFC 5766
+	// Section 6.4. The domain is value of ALTERNATE-DOMAIN attribute or
+	// empty, and should be used for server name verification on TLS.
+	//
+	// Defaults to dialing the same network for *net.UDPConn and
+	// *net.TCPConn, redirects are not followed for other connections or
+	// when Options.STUN is provided.
+	DialAlternate func(addr, domain string) (net.Conn, error)
 }
 
-// RefreshRate returns current rate of refresh requests.
+// RefreshRate returns rate of refresh requests, or zero if refreshes are
+// disabled. The rate is only used if set by Options.RefreshRate, otherwise
+// refreshes are scheduled by lifetimes granted by server and returned
+// value is nominal default rate.
 func (c *Client) RefreshRate() time.Duration { return c.refreshRate }
 
 const defaultRefreshRate = time.Minute
@@ -67,56 +138,112 @@ func New(o Options) (*Client, error) {
 		o.Log = zap.NewNop()
 	}
 	c := &Client{
-		password: o.Password,
 		log:      o.Log,
 		conClose: true,
+		stream:   o.Stream,
 	}
 	if o.ConnManualClose {
 		o.Log.Debug("manual close is enabled")
 		c.conClose = false
 	}
-	if o.STUN == nil {
+	if o.NoRetransmit {
+		c.stunOptions = append(c.stunOptions, stun.WithNoRetransmit)
+	}
+	if o.RTO > 0 {
+		c.stunOptions = append(c.stunOptions, stun.WithRTO(o.RTO))
+	}
+	c.dialAlternate = o.DialAlternate
+	c.recover = o.Recover
+	c.onRecover = o.OnRecover
+	if c.dialAlternate == nil {
+		c.dialAlternate = defaultDialAlternate(o.Conn)
+	}
+	conn := o.Conn
+	if o.ConnManualClose && o.STUN == nil {
+		c.manualConn = &manualConn{Conn: o.Conn}
+		conn = c.manualConn
+	}
+	if err := c.setConn(conn, o.STUN); err != nil {
+		return nil, err
+	}
+	c.refreshRate = defaultRefreshRate
+	if o.RefreshRate > 0 {
+		c.refreshRate = o.RefreshRate
+		c.fixedRate = true
+	}
+	if o.RefreshDisabled {
+		c.refreshRate = 0
+	}
+	c.credentials = o.Credentials
+	if c.credentials == nil {
+		c.credentials = StaticCredentials(o.Username, o.Password)
+	}
+	c.tokens = o.Tokens
+	c.userHash = o.UserHash
+	c.scheduler = newScheduler()
+	c.dialData = o.DialData
+	if c.dialData == nil {
+		c.dialData = func() (net.Conn, error) {
+			_, conn := c.server()
+			return net.Dial("tcp", conn.RemoteAddr().String())
+		}
+	}
+	return c, nil
+}
+
+// setConn sets up connection to server, starting reading from it. The STUN
+// client is created on multiplexed connection if stunClient is nil.
+//
+// The c.connMux should be locked if connection is replaced.
+func (c *Client) setConn(conn net.Conn, stunClient STUNClient) error {
+	stream := c.stream
+	raw := conn
+	if m, ok := conn.(*manualConn); ok {
+		raw = m.Conn
+	}
+	switch raw.(type) {
+	case *net.TCPConn, *tls.Conn:
+		stream = true
+	}
+	if stream {
+		c.log.Debug("stream framing is enabled")
+		conn = newStreamConn(conn)
+	}
+	c.customSTUN = stunClient != nil
+	if stunClient == nil {
 		// Setting up de-multiplexing.
-		m := newMultiplexer(o.Conn, c.log)
+		m := newMultiplexer(conn, c.log, &c.stats)
 		go m.discardData() // discarding any non-stun/turn data
-		o.Conn = bypassWriter{
+		conn = bypassWriter{
 			reader: m.turnL,
 			writer: m.conn,
 		}
 		// Starting STUN client on multiplexed connection.
-		var err error
-		stunOptions := []stun.ClientOption{
+		stunOptions := append([]stun.ClientOption{
 			stun.WithHandler(c.stunHandler),
-		}
-		if o.NoRetransmit {
-			stunOptions = append(stunOptions, stun.WithNoRetransmit)
-		}
-		if o.RTO > 0 {
-			stunOptions = append(stunOptions, stun.WithRTO(o.RTO))
-		}
-		o.STUN, err = stun.NewClient(bypassWriter{
+		}, c.stunOptions...)
+		var err error
+		stunClient, err = stun.NewClient(bypassWriter{
 			reader: m.stunL,
 			writer: m.conn,
 		}, stunOptions...)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 	c.done = make(chan struct{})
-	c.stun = o.STUN
-	c.con = o.Conn
-	c.refreshRate = defaultRefreshRate
-	if o.RefreshRate > 0 {
-		c.refreshRate = o.RefreshRate
-	}
-	if o.RefreshDisabled {
-		c.refreshRate = 0
-	}
-	if o.Username != "" {
-		c.username = stun.NewUsername(o.Username)
-	}
-	go c.readUntilClosed()
-	return c, nil
+	c.stun = stunClient
+	c.con = conn
+	go c.readUntilClosed(conn, c.done)
+	return nil
+}
+
+// server returns STUN client and connection to server, which are
+// replaced on redirect.
+func (c *Client) server() (STUNClient, net.Conn) {
+	c.connMux.RLock()
+	defer c.connMux.RUnlock()
+	return c.stun, c.con
 }
 
 // STUNClient abstracts STUN protocol interaction.
@@ -126,13 +253,35 @@ type STUNClient interface {
 	Close() error
 }
 
+// ContextSTUNClient is STUNClient with context-aware transactions, which
+// are stopped when context is done. Used by context-aware methods like
+// Client.AllocateContext if implemented by Options.STUN.
+//
+// The default STUN client can't stop transactions, so they are completed
+// in background when context is done. Allocation that is created by server
+// after that is deleted, while permissions and channel bindings can still
+// be installed on server, where they expire without refreshes.
+type ContextSTUNClient interface {
+	STUNClient
+	DoContext(ctx context.Context, m *stun.Message, f func(e stun.Event)) error
+}
+
 var dataIndication = stun.NewType(stun.MethodData, stun.ClassIndication)
 
+// stunHandler handles incoming STUN messages that are not responses.
+//
+// Data is passed to Connection or ReadFrom without blocking, so handling
+// is bounded, and data from peers without installed permission is
+// dropped.
 func (c *Client) stunHandler(e stun.Event) {
 	if e.Error != nil {
 		// Just ignoring.
 		return
 	}
+	if e.Message.Type == connectionAttemptIndication {
+		c.handleConnectionAttempt(e.Message)
+		return
+	}
 	if e.Message.Type != dataIndication {
 		return
 	}
@@ -141,69 +290,80 @@ func (c *Client) stunHandler(e stun.Event) {
 		addr turn.PeerAddress
 	)
 	if err := e.Message.Parse(&data, &addr); err != nil {
-		c.log.Error("failed to parse while handling incoming STUN message", zap.Error(err))
+		atomic.AddUint64(&c.stats.malformedSTUN, 1)
+		c.log.Debug("failed to parse while handling incoming STUN message", zap.Error(err))
 		return
 	}
 	c.mux.RLock()
-	for i := range c.alloc.perms {
-		for j := range c.alloc.perms[i].conn {
-			if !turn.Addr(c.alloc.perms[i].conn[j].peerAddr).Equal(turn.Addr(addr)) {
-				continue
-			}
-			if _, err := c.alloc.perms[i].conn[j].peerL.Write(data); err != nil {
-				c.log.Error("failed to write", zap.Error(err))
-			}
-		}
-	}
+	a := c.alloc
 	c.mux.RUnlock()
+	if a == nil {
+		return
+	}
+	p := a.findPermission(addr.IP)
+	if p == nil {
+		atomic.AddUint64(&c.stats.unpermittedData, 1)
+		c.log.Debug("dropped data from peer without permission", zap.Stringer("addr", turn.Addr(addr)))
+		return
+	}
+	if conn := p.connection(addr); conn != nil {
+		conn.handlePacket(data)
+		return
+	}
+	// No Connection to peer, passing to Allocation.ReadFrom.
+	a.handlePacket(data, turn.Addr(addr))
 }
 
+// handleChannelData passes ChannelData to Connection that is bound to
+// its channel number.
 func (c *Client) handleChannelData(data *turn.ChannelData) {
-	c.log.Debug("handleChannelData", zap.Int("n", int(data.Number)))
+	var conn *Connection
 	c.mux.RLock()
-	for i := range c.alloc.perms {
-		for j := range c.alloc.perms[i].conn {
-			if data.Number != c.alloc.perms[i].conn[j].Binding() {
-				continue
-			}
-			if _, err := c.alloc.perms[i].conn[j].peerL.Write(data.Data); err != nil {
-				c.log.Error("failed to write", zap.Error(err))
-			}
-		}
+	if c.alloc != nil {
+		conn = c.alloc.channels[data.Number]
 	}
 	c.mux.RUnlock()
+	if conn == nil {
+		atomic.AddUint64(&c.stats.unpermittedData, 1)
+		c.log.Debug("dropped data for unbound channel", zap.Int("n", int(data.Number)))
+		return
+	}
+	conn.handlePacket(data.Data)
 }
 
-func (c *Client) readUntilClosed() {
-	buf := make([]byte, 1500)
+// handleTURNData decodes and handles ChannelData message from b, ignoring
+// other messages.
+func (c *Client) handleTURNData(b []byte) {
+	if !turn.IsChannelData(b) {
+		return
+	}
+	data := &turn.ChannelData{Raw: b}
+	if err := data.Decode(); err != nil {
+		atomic.AddUint64(&c.stats.malformedChannelData, 1)
+		c.log.Debug("failed to decode ChannelData", zap.Error(err))
+		return
+	}
+	c.handleChannelData(data)
+}
+
+func (c *Client) readUntilClosed(conn net.Conn, done chan struct{}) {
+	buf := make([]byte, packetSize)
 	for {
-		n, err := c.con.Read(buf)
+		n, err := conn.Read(buf)
 		if err != nil {
-			if err == io.EOF {
-				continue
-			}
 			c.log.Debug("read error", zap.Error(err))
 			c.log.Info("connection closed")
 			break
 		}
-		data := buf[:n]
-		if !turn.IsChannelData(data) {
-			continue
-		}
-		cData := &turn.ChannelData{
-			Raw: make([]byte, n),
-		}
-		copy(cData.Raw, data)
-		if err := cData.Decode(); err != nil {
-			panic(err)
-		}
-		go c.handleChannelData(cData)
+		// Data is copied by handlers, so buffer is reused.
+		c.handleTURNData(buf[:n])
 	}
-	close(c.done)
+	close(done)
 }
 
 func (c *Client) sendData(buf []byte, peerAddr *turn.PeerAddress) (int, error) {
-	err := c.stun.Indicate(stun.MustBuild(stun.TransactionID,
+	stunClient, _ := c.server()
+	err := stunClient.Indicate(stun.MustBuild(stun.TransactionID,
 		stun.NewType(stun.MethodSend, stun.ClassIndication),
 		turn.Data(buf), peerAddr,
 	))
@@ -222,12 +382,82 @@ func (c *Client) sendChan(buf []byte, n turn.ChannelNumber) (int, error) {
 		Number: n,
 	}
 	d.Encode()
-	return c.con.Write(d.Raw)
+	_, conn := c.server()
+	return conn.Write(d.Raw)
 }
 
 func (c *Client) do(req, res *stun.Message) error {
+	return c.doContext(context.Background(), req, res)
+}
+
+// doContext performs transaction, returning ctx.Err() if ctx is done
+// before the transaction is completed.
+//
+// The transaction is stopped only if STUN client implements
+// ContextSTUNClient, otherwise it is completed in background and result
+// is ignored.
+func (c *Client) doContext(ctx context.Context, req, res *stun.Message) error {
+	return c.doContextLate(ctx, req, res, nil)
+}
+
+// doContextLate is like doContext, but calls late (if not nil) with
+// response to transaction that is completed in background after ctx is
+// done, so its effect on server can be reverted.
+func (c *Client) doContextLate(ctx context.Context, req, res *stun.Message, late func(res *stun.Message)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stunClient, _ := c.server()
+	if s, ok := stunClient.(ContextSTUNClient); ok {
+		return doWith(func(f func(e stun.Event)) error {
+			return s.DoContext(ctx, req, f)
+		}, res)
+	}
+	if ctx.Done() == nil {
+		// Context can't be done, so no need to wait in background.
+		return doWith(func(f func(e stun.Event)) error {
+			return stunClient.Do(req, f)
+		}, res)
+	}
+	// Using copies of messages, because they can be used by transaction
+	// after return.
+	m := new(stun.Message)
+	if err := req.CloneTo(m); err != nil {
+		return err
+	}
+	var out *stun.Message
+	if res != nil || late != nil {
+		out = stun.New()
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- doWith(func(f func(e stun.Event)) error {
+			return stunClient.Do(m, f)
+		}, out)
+	}()
+	select {
+	case err := <-result:
+		if err != nil || res == nil {
+			return err
+		}
+		return out.CloneTo(res)
+	case <-ctx.Done():
+		if late != nil {
+			go func() {
+				if err := <-result; err == nil {
+					late(out)
+				}
+			}()
+		}
+		return ctx.Err()
+	}
+}
+
+// doWith performs transaction by calling do with event handler, cloning
+// response to res if not nil.
+func doWith(do func(f func(e stun.Event)) error, res *stun.Message) error {
 	var stunErr error
-	if doErr := c.stun.Do(req, func(e stun.Event) {
+	if doErr := do(func(e stun.Event) {
 		if e.Error != nil {
 			stunErr = e.Error
 			return
@@ -244,19 +474,53 @@ func (c *Client) do(req, res *stun.Message) error {
 	return stunErr
 }
 
+// Close deletes allocation and closes underlying connection, unless
+// ConnManualClose is set. Connection that is left open is no longer read
+// by client.
 func (c *Client) Close() error {
-	if !c.conClose {
-		// TODO(ernado): Cleanup all resources.
+	c.mux.RLock()
+	a := c.alloc
+	c.mux.RUnlock()
+	if a != nil {
+		if err := a.Close(); err != nil {
+			c.log.Warn("failed to close allocation", zap.Error(err))
+		}
+	}
+	c.scheduler.close()
+	c.connMux.Lock()
+	conn, stunClient, done, conClose, manual := c.con, c.stun, c.done, c.conClose, c.manualConn
+	c.manualConn = nil
+	c.connMux.Unlock()
+	if !conClose {
+		if manual != nil {
+			c.stopConn(conn, stunClient, done, manual)
+		}
 		return nil
 	}
 	c.log.Error("closing connection")
-	if err := c.con.Close(); err != nil {
+	if err := conn.Close(); err != nil {
 		return err
 	}
-	if err := c.stun.Close(); err != nil {
+	if err := stunClient.Close(); err != nil {
 		c.log.Error("failed to close stun client", zap.Error(err))
 	}
-	<-c.done
+	<-done
 	c.log.Error("done signaled")
 	return nil
 }
+
+// stopConn closes STUN client and connection to server, waiting until
+// reading is stopped. Connection provided by user with
+// Options.ConnManualClose is left open.
+func (c *Client) stopConn(conn net.Conn, stunClient STUNClient, done chan struct{}, manual *manualConn) {
+	closeLogged(c.log, "failed to close connection", conn)
+	closeLogged(c.log, "failed to close stun client", stunClient)
+	<-done
+	if manual == nil {
+		return
+	}
+	// Reads are stopped, so resetting deadline that interrupted them.
+	if err := manual.SetReadDeadline(time.Time{}); err != nil {
+		c.log.Warn("failed to reset read deadline", zap.Error(err))
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -18,15 +19,34 @@ import (
 type Allocation struct {
 	log         *zap.Logger
 	client      *Client
-	relayed     turn.RelayedAddress
-	reflexive   stun.XORMappedAddress
-	perms       []*Permission // protected with client.mux
+	addrMux     sync.RWMutex
+	gen         uint64                // protected with addrMux, incremented by recover
+	relayed     turn.RelayedAddress   // protected with addrMux
+	addrs       []turn.RelayedAddress // protected with addrMux, see RelayedAddrs
+	familyErr   *AddressFamilyError   // protected with addrMux
+	reflexive   stun.XORMappedAddress // protected with addrMux
+	token       []byte                // reservation token for the next port
+	perms       []*Permission         // protected with client.mux
 	minBound    turn.ChannelNumber
-	integrity   stun.MessageIntegrity
-	nonce       stun.Nonce
+	channels    map[turn.ChannelNumber]*Connection // bound connections, protected with client.mux
+	authMux     sync.RWMutex
+	auth        longTermAuth // protected with authMux
 	refreshRate time.Duration
+	transport   turn.Protocol
+	opts        AllocateOptions  // for reallocation, see recover
+	recoverMux  sync.Mutex       // serializes recover
+	listener    *tcpListener     // protected with client.mux
+	accepted    chan *Connection // protected with client.mux, see AcceptUDP
+	packets     *packetQueue
+	createMux   sync.Mutex // serializes permission creation in WriteTo
 	ctx         context.Context
 	cancel      context.CancelFunc
+	lifetimeMux sync.RWMutex
+	lifetime    time.Duration // protected with lifetimeMux
+	expires     time.Time     // protected with lifetimeMux
+	task        *refreshTask
+	closeOnce   sync.Once
+	closeErr    error
 }
 
 func (a *Allocation) removePermission(p *Permission) {
@@ -42,274 +62,435 @@ func (a *Allocation) removePermission(p *Permission) {
 	a.client.mux.Unlock()
 }
 
-var errUnauthorised = errors.New("unauthorized")
-
-// allocate expects client.mux locked.
-func (c *Client) allocate(req, res *stun.Message) (*Allocation, error) {
-	if doErr := c.do(req, res); doErr != nil {
+// allocate performs Allocate transaction, returning new allocation on
+// success. Response is verified if request is authenticated with auth.
+func (c *Client) allocate(ctx context.Context, req, res *stun.Message, auth longTermAuth) (*Allocation, error) {
+	late := func(late *stun.Message) { c.deleteAbandoned(late, auth) }
+	if doErr := c.doContextLate(ctx, req, res, late); doErr != nil {
 		return nil, doErr
 	}
+	if err := c.checkResponseIntegrity(auth, res); err != nil {
+		return nil, err
+	}
 	if res.Type == stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse) {
 		var (
-			relayed   turn.RelayedAddress
 			reflexive stun.XORMappedAddress
-			nonce     stun.Nonce
+			familyErr *AddressFamilyError
 		)
 		// Getting relayed and reflexive addresses from response.
-		if err := relayed.GetFrom(res); err != nil {
+		relayed, err := relayedAddresses(res)
+		if err != nil {
 			return nil, err
 		}
 		if err := reflexive.GetFrom(res); err != nil && err != stun.ErrAttributeNotFound {
 			return nil, err
 		}
-		// Getting nonce from request.
-		if err := nonce.GetFrom(req); err != nil && err != stun.ErrAttributeNotFound {
+		// Server can fail to allocate one of address families.
+		if code := new(AddressFamilyError); code.GetFrom(res) == nil {
+			c.log.Warn("failed to allocate address family", zap.Error(code))
+			familyErr = code
+		}
+		lifetime, err := lifetimeFrom(res, turn.DefaultLifetime)
+		if err != nil {
+			return nil, err
+		}
+		// Server returns token if next port is reserved.
+		var token turn.ReservationToken
+		if err := token.GetFrom(res); err != nil && err != stun.ErrAttributeNotFound {
 			return nil, err
 		}
 		a := &Allocation{
 			client:      c,
 			log:         c.log,
 			reflexive:   reflexive,
-			relayed:     relayed,
+			relayed:     relayed[0],
+			addrs:       relayed,
+			familyErr:   familyErr,
+			token:       append([]byte(nil), token...),
 			minBound:    turn.MinChannelNumber,
-			integrity:   c.integrity,
-			nonce:       nonce,
 			refreshRate: c.refreshRate,
+			packets:     newPacketQueue(),
+			channels:    make(map[turn.ChannelNumber]*Connection),
 		}
-		c.alloc = a
+		a.ctx, a.cancel = context.WithCancel(context.Background())
+		a.setLifetime(lifetime)
 		return a, nil
 	}
-	// Anonymous allocate failed, trying to authenticate.
-	if res.Type.Method != stun.MethodAllocate {
+	if res.Type != stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse) {
 		return nil, fmt.Errorf("unexpected response type %s", res.Type)
 	}
-	var (
-		code stun.ErrorCodeAttribute
-	)
+	var code stun.ErrorCodeAttribute
 	if err := code.GetFrom(res); err != nil {
 		return nil, err
 	}
-	if code.Code != stun.CodeUnauthorized {
-		return nil, fmt.Errorf("unexpected error code %d", code)
+	if code.Code == stun.CodeTryAlternate {
+		if t, err := newTryAlternate(res); err == nil {
+			return nil, t
+		}
 	}
-	return nil, errUnauthorised
+	return nil, newError(res)
+}
+
+// deleteAbandoned deletes allocation from Allocate success response that
+// was received after context of request was done, so allocation that is
+// not tracked by client does not consume quota on server until expiry.
+func (c *Client) deleteAbandoned(res *stun.Message, auth longTermAuth) {
+	if res.Type != stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse) {
+		return
+	}
+	if err := c.checkResponseIntegrity(auth, res); err != nil {
+		return
+	}
+	a := &Allocation{client: c, log: c.log, auth: auth}
+	if err := a.refreshLifetime(0); err != nil {
+		c.log.Warn("failed to delete abandoned allocation", zap.Error(err))
+		return
+	}
+	c.log.Info("abandoned allocation deleted")
+}
+
+// ProtoTCP is IANA assigned protocol number for TCP, used as
+// AllocateOptions.Transport for TCP allocations (RFC 6062).
+const ProtoTCP turn.Protocol = 6
+
+// AllocateOptions contains options for allocation request.
+type AllocateOptions struct {
+	// Transport is requested transport protocol for relayed transport
+	// address, turn.ProtoUDP by default. Use ProtoTCP for relaying to peers
+	// over TCP, which requires TCP or TLS connection to server.
+	Transport turn.Protocol
+	// Family is requested address family of relayed transport address.
+	// Use FamilyDualStack to get both IPv4 and IPv6 addresses, see
+	// Allocation.RelayedAddrs.
+	Family AddressFamily
+	// EvenPort requests relayed transport address with even port, and
+	// ReservePort also requests server to reserve the next-higher port,
+	// returning token for it, see Allocation.ReservationToken.
+	EvenPort    bool
+	ReservePort bool
+	// ReservationToken requests relayed transport address that was
+	// reserved by previous allocation. Can't be used with EvenPort or
+	// Family.
+	ReservationToken []byte
+}
+
+// errReservationToken means that reservation token is used with
+// conflicting options, RFC 5766 Section 6.1.
+var errReservationToken = errors.New("reservation token can't be used with even port or address family")
+
+// allocateAttributes adds attributes from allocate options to request.
+type allocateAttributes AllocateOptions
+
+func (o allocateAttributes) AddTo(m *stun.Message) error {
+	setters := []stun.Setter{
+		turn.RequestedTransport{Protocol: o.Transport},
+		o.Family,
+	}
+	if o.EvenPort || o.ReservePort {
+		setters = append(setters, turn.EvenPort{ReservePort: o.ReservePort})
+	}
+	if len(o.ReservationToken) > 0 {
+		setters = append(setters, turn.ReservationToken(o.ReservationToken))
+	}
+	for _, s := range setters {
+		if err := s.AddTo(m); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Allocate creates an allocation for current 5-tuple. Currently there can be
 // only one allocation per client, because client wraps one net.Conn.
 func (c *Client) Allocate() (*Allocation, error) {
+	return c.AllocateWithOptions(AllocateOptions{})
+}
+
+// AllocateContext is like Allocate, but aborts allocation when ctx is done.
+//
+// See ContextSTUNClient for transactions that are done after ctx.
+func (c *Client) AllocateContext(ctx context.Context) (*Allocation, error) {
+	return c.AllocateWithOptionsContext(ctx, AllocateOptions{})
+}
+
+// AllocateWithOptions creates an allocation for current 5-tuple with
+// provided options.
+//
+// If server responds with 300 (Try Alternate), the client connects to
+// alternate server via Options.DialAlternate and allocates there.
+func (c *Client) AllocateWithOptions(o AllocateOptions) (*Allocation, error) {
+	return c.AllocateWithOptionsContext(context.Background(), o)
+}
+
+// AllocateWithOptionsContext is like AllocateWithOptions, but aborts
+// allocation when ctx is done, see AllocateContext.
+func (c *Client) AllocateWithOptionsContext(ctx context.Context, o AllocateOptions) (*Allocation, error) {
+	if o.Transport == 0 {
+		o.Transport = turn.ProtoUDP
+	}
+	if len(o.ReservationToken) > 0 && (o.EvenPort || o.ReservePort || o.Family != FamilyDefault) {
+		return nil, errReservationToken
+	}
+	a, err := c.allocateRedirect(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+	a.opts = o
+	c.mux.Lock()
+	c.alloc = a
+	c.mux.Unlock()
+	a.startRefresh()
+	return a, nil
+}
+
+// allocateRedirect performs allocation, following redirects to alternate
+// servers.
+func (c *Client) allocateRedirect(ctx context.Context, o AllocateOptions) (*Allocation, error) {
+	_, conn := c.server()
+	tried := map[string]bool{
+		conn.RemoteAddr().String(): true,
+	}
+	for redirects := 0; ; redirects++ {
+		a, err := c.allocateWithOptions(ctx, o)
+		t, ok := err.(*tryAlternate)
+		if !ok {
+			return a, err
+		}
+		if redirects == maxRedirects || tried[t.addr] {
+			return nil, ErrRedirectLoop
+		}
+		tried[t.addr] = true
+		if err := c.redirect(t); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) allocateWithOptions(ctx context.Context, o AllocateOptions) (*Allocation, error) {
 	var (
-		nonce stun.Nonce
 		res   = stun.New()
+		attrs = allocateAttributes(o)
 	)
 	req, reqErr := stun.Build(stun.TransactionID,
-		turn.AllocateRequest, turn.RequestedTransportUDP,
+		turn.AllocateRequest, attrs,
 		stun.Fingerprint,
 	)
 	if reqErr != nil {
 		return nil, reqErr
 	}
-	a, allocErr := c.allocate(req, res)
+	a, allocErr := c.allocate(ctx, req, res, longTermAuth{})
 	if allocErr == nil {
+		a.transport = o.Transport
 		return a, nil
 	}
-	if allocErr != errUnauthorised {
+	var resErr *Error
+	if !errors.As(allocErr, &resErr) || resErr.Code != stun.CodeUnauthorized {
 		return nil, allocErr
 	}
 	// Anonymous allocate failed, trying to authenticate.
-	if err := nonce.GetFrom(res); err != nil {
-		return nil, err
-	}
-	if err := c.realm.GetFrom(res); err != nil {
-		return nil, err
+	auth, authErr := c.authenticate(res)
+	if authErr != nil {
+		return nil, authErr
 	}
-	c.realm = append([]byte(nil), c.realm...)
-	c.integrity = stun.NewLongTermIntegrity(
-		c.username.String(), c.realm.String(), c.password,
-	)
-	// Trying to authorize.
 	if reqErr = req.Build(stun.TransactionID,
-		turn.AllocateRequest, turn.RequestedTransportUDP,
-		&c.username, &c.realm,
-		&nonce,
-		&c.integrity, stun.Fingerprint,
+		turn.AllocateRequest, attrs,
+		auth, stun.Fingerprint,
 	); reqErr != nil {
 		return nil, reqErr
 	}
-	a, err := c.allocate(req, res)
+	a, err := c.allocate(ctx, req, res, auth)
 	if err != nil {
 		return a, err
 	}
-
-	a.ctx, a.cancel = context.WithCancel(context.Background())
-	a.startRefreshLoop()
-
+	a.auth = auth
+	a.transport = o.Transport
 	return a, nil
 }
 
+// Close deletes allocation on server by Refresh request with zero
+// lifetime, stopping refreshing and closing all permissions, connections
+// and listeners. Subsequent calls are no-op.
 func (a *Allocation) Close() error {
+	a.closeOnce.Do(func() {
+		a.closeErr = a.close()
+	})
+	return a.closeErr
+}
+
+func (a *Allocation) close() error {
 	a.cancel()
-	a.client.mux.Lock()
-	for _, perm := range a.perms {
+	if a.task != nil {
+		a.client.scheduler.remove(a.task)
+	}
+	a.packets.close()
+	a.client.mux.RLock()
+	l := a.listener
+	a.client.mux.RUnlock()
+	if l != nil {
+		closeLogged(a.log, "failed to close listener", l)
+	}
+	// Permission.Close removes permission from allocation, so closing
+	// copy of permissions list without holding the lock.
+	a.client.mux.RLock()
+	perms := append([]*Permission(nil), a.perms...)
+	a.client.mux.RUnlock()
+	for _, perm := range perms {
 		perm.Close()
 	}
-	a.client.mux.Unlock()
-
+	if err := a.refreshLifetime(0); err != nil && !errors.Is(err, ErrAllocationMismatch) {
+		// Ignoring mismatch, because allocation can be already deleted,
+		// e.g. expired.
+		return err
+	}
+	a.log.Debug("allocation deleted")
 	return nil
 }
 
-func (a *Allocation) allocate(peer turn.PeerAddress) error {
-	req := stun.New()
-	req.TransactionID = stun.NewTransactionID()
-	req.Type = stun.NewType(stun.MethodCreatePermission, stun.ClassRequest)
-	req.WriteHeader()
-	setters := make([]stun.Setter, 0, 10)
-	setters = append(setters, &peer)
-	if len(a.integrity) > 0 {
-		// Applying auth.
-		setters = append(setters,
-			a.nonce, a.client.username, a.client.realm, a.integrity,
-		)
-	}
-	setters = append(setters, stun.Fingerprint)
-	for _, s := range setters {
-		if setErr := s.AddTo(req); setErr != nil {
-			return setErr
+// maxPeersPerRequest is maximum count of XOR-PEER-ADDRESS attributes in
+// single CreatePermission request, so request with IPv6 peers fits into
+// minimum IPv6 MTU.
+const maxPeersPerRequest = 32
+
+// allocate installs or refreshes permissions for provided peers,
+// performing CreatePermission transaction for each batch of peers.
+func (a *Allocation) allocate(ctx context.Context, peers ...turn.PeerAddress) error {
+	for len(peers) > maxPeersPerRequest {
+		if err := a.createPermission(ctx, peers[:maxPeersPerRequest]); err != nil {
+			return err
 		}
+		peers = peers[maxPeersPerRequest:]
+	}
+	return a.createPermission(ctx, peers)
+}
+
+// createPermission performs CreatePermission transaction with multiple
+// XOR-PEER-ADDRESS attributes, RFC 5766 Section 9.1.
+func (a *Allocation) createPermission(ctx context.Context, peers []turn.PeerAddress) error {
+	setters := make([]stun.Setter, 0, len(peers))
+	for i := range peers {
+		setters = append(setters, &peers[i])
 	}
 	res := stun.New()
-	if doErr := a.client.do(req, res); doErr != nil {
+	if doErr := a.do(ctx, stun.MethodCreatePermission, setters, res); doErr != nil {
 		return doErr
 	}
-	if res.Type.Class == stun.ClassErrorResponse {
-		var code stun.ErrorCodeAttribute
-		err := fmt.Errorf("unexpected error response: %s", res.Type)
-		if getErr := code.GetFrom(res); getErr == nil {
-			err = fmt.Errorf("unexpected error response: %s (error %s)",
-				res.Type, code,
-			)
-		}
-		return err
-	}
-
-	return nil
+	return checkResponse(stun.MethodCreatePermission, res)
 }
 
 // Relayed returns the relayed address for the allocation.
 func (a *Allocation) Relayed() turn.RelayedAddress {
+	a.addrMux.RLock()
+	defer a.addrMux.RUnlock()
 	return a.relayed
 }
 
-// CreateUDP creates new UDP Permission to peer with provided addr.
+// Create creates new Permission to peer with provided ip.
 func (a *Allocation) Create(ip net.IP) (*Permission, error) {
-	peer := turn.PeerAddress{
-		IP:   ip,
-		Port: 0, // Does not matter.
-	}
-	if err := a.allocate(peer); err != nil {
+	return a.CreateContext(context.Background(), ip)
+}
+
+// CreateContext is like Create, but aborts permission creation when ctx
+// is done.
+//
+// See ContextSTUNClient for transactions that are done after ctx.
+func (a *Allocation) CreateContext(ctx context.Context, ip net.IP) (*Permission, error) {
+	perms, err := a.CreateManyContext(ctx, []net.IP{ip})
+	if err != nil {
 		return nil, err
 	}
-	p := &Permission{
-		log:         a.log,
-		ip:          ip,
-		client:      a.client,
-		refreshRate: a.client.refreshRate,
-	}
-	p.ctx, p.cancel = context.WithCancel(context.Background())
-	p.startRefreshLoop()
-	a.client.mux.Lock()
-	a.perms = append(a.perms, p)
-	a.client.mux.Unlock()
-	return p, nil
+	return perms[0], nil
 }
 
-func (a *Allocation) startRefreshLoop() {
-	a.startLoop(func() {
-		if err := a.refresh(); err != nil {
-			a.log.Error("failed to refresh allocation", zap.Error(err))
-		}
-		a.log.Debug("allocation refreshed")
-	})
+// CreateMany creates new Permission for each of provided ips, installing
+// them in batches with single CreatePermission request per batch.
+//
+// Permissions are returned in the same order as ips. On error, no
+// permissions are returned, while some of them can be installed on
+// server until expiration.
+func (a *Allocation) CreateMany(ips []net.IP) ([]*Permission, error) {
+	return a.CreateManyContext(context.Background(), ips)
 }
 
-func (a *Allocation) refresh() error {
-	res := stun.New()
-	req := stun.New()
-
-	err := a.doRefresh(res, req)
-	if err != nil {
-		return err
+// CreateManyContext is like CreateMany, but aborts permission creation
+// when ctx is done, see CreateContext.
+func (a *Allocation) CreateManyContext(ctx context.Context, ips []net.IP) ([]*Permission, error) {
+	if len(ips) == 0 {
+		return nil, nil
 	}
-
-	if res.Type == stun.NewType(stun.MethodRefresh, stun.ClassErrorResponse) {
-		var errCode stun.ErrorCodeAttribute
-		if codeErr := errCode.GetFrom(res); codeErr != nil {
-			return codeErr
+	peers := make([]turn.PeerAddress, 0, len(ips))
+	for _, ip := range ips {
+		peers = append(peers, turn.PeerAddress{
+			IP:   ip,
+			Port: 0, // Does not matter.
+		})
+	}
+	if err := a.allocate(ctx, peers...); err != nil {
+		return nil, err
+	}
+	perms := make([]*Permission, 0, len(ips))
+	for _, ip := range ips {
+		p := &Permission{
+			log:         a.log,
+			ip:          ip,
+			client:      a.client,
+			refreshRate: a.client.refreshRate,
+			refreshed:   time.Now(),
 		}
+		p.startRefresh()
+		perms = append(perms, p)
+	}
+	a.client.mux.Lock()
+	a.perms = append(a.perms, perms...)
+	a.client.mux.Unlock()
+	return perms, nil
+}
 
-		if errCode.Code == stun.CodeStaleNonce {
-			var nonce stun.Nonce
-
-			if nonceErr := nonce.GetFrom(res); nonceErr != nil {
-				return nonceErr
-			}
-			a.nonce = nonce
-			res = stun.New()
-			req = stun.New()
-			err = a.doRefresh(res, req)
-			if err != nil {
-				return err
-			}
-		}
+func (a *Allocation) startRefresh() {
+	if a.refreshRate == 0 {
+		return
+	}
+	a.task = &refreshTask{
+		log:  a.log,
+		name: "allocation",
+		interval: func() time.Duration {
+			return a.client.refreshInterval(a.Lifetime())
+		},
+		refresh: a.refresh,
 	}
+	a.client.scheduler.add(a.task)
+}
 
-	if res.Type != stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse) {
-		return fmt.Errorf("unexpected response type %s", res.Type)
+func (a *Allocation) refresh() error {
+	gen := a.generation()
+	// Renewing credentials that expire before next refresh, so allocation
+	// is created again with new username while current credentials are
+	// valid.
+	next := time.Now().Add(a.client.refreshInterval(a.Lifetime()))
+	if err := a.renewAuth(next); err != nil && a.client.recover {
+		return a.reallocate(gen)
 	}
-	// Success.
-	return nil
+	return a.recoverLost(gen, a.refreshLifetime(turn.DefaultLifetime))
 }
 
-func (a *Allocation) doRefresh(res, req *stun.Message) error {
-	req.TransactionID = stun.NewTransactionID()
-	req.Type = stun.NewType(stun.MethodRefresh, stun.ClassRequest)
-	req.WriteHeader()
-	setters := make([]stun.Setter, 0, 10)
-	if len(a.integrity) > 0 {
-		// Applying auth.
-		setters = append(setters,
-			a.nonce, a.client.username, a.client.realm, a.integrity, turn.Lifetime{
-				Duration: a.refreshRate,
-			},
-		)
+// refreshLifetime performs Refresh transaction with requested lifetime.
+// Zero lifetime deletes allocation.
+func (a *Allocation) refreshLifetime(lifetime time.Duration) error {
+	res := stun.New()
+	// Attributes after MESSAGE-INTEGRITY are ignored, so lifetime is
+	// added before auth.
+	if err := a.do(context.Background(), stun.MethodRefresh, []stun.Setter{
+		turn.Lifetime{Duration: lifetime},
+	}, res); err != nil {
+		return err
 	}
-	setters = append(setters, stun.Fingerprint)
-	for _, s := range setters {
-		if setErr := s.AddTo(req); setErr != nil {
-			return setErr
-		}
+	if err := checkResponse(stun.MethodRefresh, res); err != nil {
+		return err
 	}
-	if doErr := a.client.do(req, res); doErr != nil {
-		return doErr
+	// Success.
+	granted, err := lifetimeFrom(res, lifetime)
+	if err != nil {
+		return err
 	}
-
+	a.setLifetime(granted)
 	return nil
 }
-
-func (a *Allocation) startLoop(f func()) {
-	if a.refreshRate == 0 {
-		return
-	}
-
-	go func() {
-		ticker := time.NewTicker(a.refreshRate)
-		for {
-			select {
-			case <-ticker.C:
-				f()
-			case <-a.ctx.Done():
-				return
-			}
-		}
-	}()
-}
@@ -0,0 +1,176 @@
+package turnc
+
+import (
+	"fmt"
+	"io"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+)
+
+// Attributes from RFC 8656 Section 18 for dual-stack allocations.
+const (
+	attrAdditionalAddressFamily stun.AttrType = 0x8000 // ADDITIONAL-ADDRESS-FAMILY
+	attrAddressErrorCode        stun.AttrType = 0x8001 // ADDRESS-ERROR-CODE
+)
+
+// AddressFamily is address family of requested relayed transport address.
+type AddressFamily byte
+
+// Possible values for AllocateOptions.Family.
+const (
+	// FamilyDefault does not specify address family, so server
+	// allocates IPv4 relayed transport address.
+	FamilyDefault AddressFamily = iota
+	// FamilyIPv4 requests IPv4 relayed transport address.
+	FamilyIPv4
+	// FamilyIPv6 requests IPv6 relayed transport address, RFC 6156.
+	FamilyIPv6
+	// FamilyDualStack requests both IPv4 and IPv6 relayed transport
+	// addresses, RFC 8656 Section 7.2.
+	FamilyDualStack
+)
+
+func (f AddressFamily) String() string {
+	switch f {
+	case FamilyDefault:
+		return "default"
+	case FamilyIPv4:
+		return "IPv4"
+	case FamilyIPv6:
+		return "IPv6"
+	case FamilyDualStack:
+		return "dual-stack"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(f))
+	}
+}
+
+// AddTo adds REQUESTED-ADDRESS-FAMILY or ADDITIONAL-ADDRESS-FAMILY to
+// allocate request.
+func (f AddressFamily) AddTo(m *stun.Message) error {
+	switch f {
+	case FamilyDefault:
+		return nil
+	case FamilyIPv4:
+		return turn.RequestedFamilyIPv4.AddTo(m)
+	case FamilyIPv6:
+		return turn.RequestedFamilyIPv6.AddTo(m)
+	case FamilyDualStack:
+		// IPv4 is allocated by default, so only additional IPv6 is
+		// requested.
+		return additionalAddressFamily(turn.RequestedFamilyIPv6).AddTo(m)
+	default:
+		return fmt.Errorf("unknown address family %s", f)
+	}
+}
+
+// additionalAddressFamily represents ADDITIONAL-ADDRESS-FAMILY attribute,
+// RFC 8656 Section 18.11.
+type additionalAddressFamily turn.RequestedAddressFamily
+
+const additionalFamilySize = 4
+
+// AddTo adds ADDITIONAL-ADDRESS-FAMILY to message.
+func (f additionalAddressFamily) AddTo(m *stun.Message) error {
+	v := make([]byte, additionalFamilySize)
+	v[0] = byte(f)
+	m.Add(attrAdditionalAddressFamily, v)
+	return nil
+}
+
+// AddressFamilyError is returned by Allocation.FamilyError when server
+// failed to allocate one of requested address families, as described in
+// ADDRESS-ERROR-CODE attribute, RFC 8656 Section 18.12.
+type AddressFamilyError struct {
+	Family turn.RequestedAddressFamily
+	Code   stun.ErrorCode
+	Reason string
+}
+
+func (e *AddressFamilyError) Error() string {
+	return fmt.Sprintf("failed to allocate %s address: %d %s", e.Family, e.Code, e.Reason)
+}
+
+const (
+	addressErrorCodeReasonStart = 4
+	addressErrorCodeClassByte   = 2
+	addressErrorCodeNumberByte  = 3
+	addressErrorCodeModulo      = 100
+	addressErrorCodeClassMask   = 0x07
+)
+
+// AddTo adds ADDRESS-ERROR-CODE to message.
+func (e *AddressFamilyError) AddTo(m *stun.Message) error {
+	v := make([]byte, addressErrorCodeReasonStart+len(e.Reason))
+	v[0] = byte(e.Family)
+	v[addressErrorCodeClassByte] = byte(e.Code / addressErrorCodeModulo)
+	v[addressErrorCodeNumberByte] = byte(e.Code % addressErrorCodeModulo)
+	copy(v[addressErrorCodeReasonStart:], e.Reason)
+	m.Add(attrAddressErrorCode, v)
+	return nil
+}
+
+// GetFrom decodes ADDRESS-ERROR-CODE from message.
+func (e *AddressFamilyError) GetFrom(m *stun.Message) error {
+	v, err := m.Get(attrAddressErrorCode)
+	if err != nil {
+		return err
+	}
+	if len(v) < addressErrorCodeReasonStart {
+		return io.ErrUnexpectedEOF
+	}
+	var (
+		class  = int(v[addressErrorCodeClassByte] & addressErrorCodeClassMask)
+		number = int(v[addressErrorCodeNumberByte])
+	)
+	e.Family = turn.RequestedAddressFamily(v[0])
+	e.Code = stun.ErrorCode(class*addressErrorCodeModulo + number)
+	e.Reason = string(v[addressErrorCodeReasonStart:])
+	return nil
+}
+
+// relayedAddresses returns all XOR-RELAYED-ADDRESS attributes from
+// message, as dual-stack allocation response can contain two of them.
+func relayedAddresses(m *stun.Message) ([]turn.RelayedAddress, error) {
+	var addrs []turn.RelayedAddress
+	for _, a := range m.Attributes {
+		if a.Type != stun.AttrXORRelayedAddress {
+			continue
+		}
+		// Decoding each attribute separately, because GetFrom returns
+		// only the first one.
+		single := stun.New()
+		single.TransactionID = m.TransactionID
+		single.WriteHeader()
+		single.Add(a.Type, a.Value)
+		var addr turn.RelayedAddress
+		if err := addr.GetFrom(single); err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, stun.ErrAttributeNotFound
+	}
+	return addrs, nil
+}
+
+// RelayedAddrs returns all relayed addresses for the allocation, which are
+// both IPv4 and IPv6 for successful dual-stack allocation.
+func (a *Allocation) RelayedAddrs() []turn.RelayedAddress {
+	a.addrMux.RLock()
+	defer a.addrMux.RUnlock()
+	return append([]turn.RelayedAddress(nil), a.addrs...)
+}
+
+// FamilyError returns *AddressFamilyError if server failed to allocate
+// one of address families for dual-stack allocation, or nil.
+func (a *Allocation) FamilyError() error {
+	a.addrMux.RLock()
+	defer a.addrMux.RUnlock()
+	if a.familyErr == nil {
+		return nil
+	}
+	return a.familyErr
+}
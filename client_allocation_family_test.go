@@ -0,0 +1,148 @@
+package turnc
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+
+	"gortc.io/turnc/internal/testutil"
+)
+
+func TestAddressFamily_AddTo(t *testing.T) {
+	for _, tc := range []struct {
+		family     AddressFamily
+		requested  turn.RequestedAddressFamily
+		additional bool
+	}{
+		{family: FamilyDefault},
+		{family: FamilyIPv4, requested: turn.RequestedFamilyIPv4},
+		{family: FamilyIPv6, requested: turn.RequestedFamilyIPv6},
+		{family: FamilyDualStack, additional: true},
+	} {
+		t.Run(tc.family.String(), func(t *testing.T) {
+			m := stun.MustBuild(tc.family)
+			var requested turn.RequestedAddressFamily
+			if err := requested.GetFrom(m); err != nil && err != stun.ErrAttributeNotFound {
+				t.Fatal(err)
+			}
+			if requested != tc.requested {
+				t.Errorf("unexpected requested family: %s", requested)
+			}
+			v, err := m.Get(attrAdditionalAddressFamily)
+			if tc.additional != (err == nil) {
+				t.Fatalf("unexpected additional family: %v", err)
+			}
+			if tc.additional && turn.RequestedAddressFamily(v[0]) != turn.RequestedFamilyIPv6 {
+				t.Errorf("unexpected additional family: %d", v[0])
+			}
+		})
+	}
+	if _, err := stun.Build(AddressFamily(100)); err == nil {
+		t.Error("should error")
+	}
+}
+
+func TestAddressFamilyError(t *testing.T) {
+	m := stun.MustBuild(&AddressFamilyError{
+		Family: turn.RequestedFamilyIPv6,
+		Code:   stun.CodeInsufficientCapacity,
+		Reason: "no capacity",
+	})
+	var e AddressFamilyError
+	if err := e.GetFrom(m); err != nil {
+		t.Fatal(err)
+	}
+	if e.Family != turn.RequestedFamilyIPv6 || e.Code != stun.CodeInsufficientCapacity || e.Reason != "no capacity" {
+		t.Errorf("unexpected decoded: %+v", e)
+	}
+	m = stun.New()
+	m.Add(attrAddressErrorCode, []byte{1, 0})
+	if err := e.GetFrom(m); err == nil {
+		t.Error("should error")
+	}
+}
+
+func TestClient_AllocateDualStack(t *testing.T) {
+	var (
+		relayedIPv4 = turn.RelayedAddress{IP: net.IPv4(127, 0, 0, 2), Port: 1113}
+		relayedIPv6 = turn.RelayedAddress{IP: net.ParseIP("::1"), Port: 1114}
+	)
+	for _, tc := range []struct {
+		name      string
+		setters   []stun.Setter
+		relayed   []turn.RelayedAddress
+		familyErr bool
+	}{
+		{
+			name:    "Both",
+			setters: []stun.Setter{&relayedIPv4, &relayedIPv6},
+			relayed: []turn.RelayedAddress{relayedIPv4, relayedIPv6},
+		},
+		{
+			name: "IPv4Only",
+			setters: []stun.Setter{&relayedIPv4, &AddressFamilyError{
+				Family: turn.RequestedFamilyIPv6,
+				Code:   stun.CodeAddrFamilyNotSupported,
+			}},
+			relayed:   []turn.RelayedAddress{relayedIPv4},
+			familyErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			connL, connR := net.Pipe()
+			defer mustClose(t, connL)
+			stunClient := &testSTUN{}
+			c, createErr := New(Options{
+				Log:  zap.New(core),
+				Conn: connR, // should not be used
+				STUN: stunClient,
+			})
+			if createErr != nil {
+				t.Fatal(createErr)
+			}
+			stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+				if _, err := m.Get(attrAdditionalAddressFamily); err != nil {
+					t.Error("no ADDITIONAL-ADDRESS-FAMILY")
+				}
+				setters := []stun.Setter{m, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse)}
+				setters = append(setters, tc.setters...)
+				f(stun.Event{
+					Message: stun.MustBuild(append(setters, stun.Fingerprint)...),
+				})
+				return nil
+			}
+			a, allocErr := c.AllocateWithOptions(AllocateOptions{Family: FamilyDualStack})
+			if allocErr != nil {
+				t.Fatal(allocErr)
+			}
+			relayed := a.RelayedAddrs()
+			if len(relayed) != len(tc.relayed) {
+				t.Fatalf("unexpected relayed addresses: %v", relayed)
+			}
+			for i := range relayed {
+				if !turn.Addr(relayed[i]).Equal(turn.Addr(tc.relayed[i])) {
+					t.Errorf("[%d] unexpected %s, expected %s", i, relayed[i], tc.relayed[i])
+				}
+			}
+			if !turn.Addr(a.Relayed()).Equal(turn.Addr(relayedIPv4)) {
+				t.Errorf("unexpected relayed: %s", a.Relayed())
+			}
+			var familyErr *AddressFamilyError
+			if errors.As(a.FamilyError(), &familyErr) != tc.familyErr {
+				t.Errorf("unexpected family error: %v", a.FamilyError())
+			}
+			if tc.familyErr && familyErr.Family != turn.RequestedFamilyIPv6 {
+				t.Errorf("unexpected family: %s", familyErr.Family)
+			}
+			testutil.EnsureNoErrors(t, logs)
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package turnc
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gortc.io/turn"
+)
+
+// permissionRefreshInterval is the maximum age of permission that is
+// used without refresh when refresh loop is disabled. Permissions last
+// 5 minutes, RFC 5766 Section 8.
+const permissionRefreshInterval = time.Minute * 4
+
+// peerAddress converts addr to peer address.
+func peerAddress(addr net.Addr) (turn.PeerAddress, error) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return turn.PeerAddress{IP: a.IP, Port: a.Port}, nil
+	case turn.Addr:
+		return turn.PeerAddress(a), nil
+	case *turn.Addr:
+		return turn.PeerAddress(*a), nil
+	default:
+		udpAddr, err := net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			return turn.PeerAddress{}, err
+		}
+		return turn.PeerAddress{IP: udpAddr.IP, Port: udpAddr.Port}, nil
+	}
+}
+
+// findPermission returns permission for ip or nil.
+func (a *Allocation) findPermission(ip net.IP) *Permission {
+	a.client.mux.RLock()
+	defer a.client.mux.RUnlock()
+	for _, p := range a.perms {
+		if p.ip.Equal(ip) {
+			return p
+		}
+	}
+	return nil
+}
+
+// permission returns permission for ip, creating it or refreshing on demand.
+func (a *Allocation) permission(ip net.IP) (*Permission, error) {
+	a.createMux.Lock()
+	defer a.createMux.Unlock()
+	p := a.findPermission(ip)
+	if p == nil {
+		return a.Create(ip)
+	}
+	if p.refreshRate == 0 && time.Since(p.refreshedAt()) > permissionRefreshInterval {
+		// Refresh loop is disabled, so refreshing before use.
+		if err := p.refresh(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// ReadFrom implements net.PacketConn, reading data from any permitted peer
+// that has no Connection.
+func (a *Allocation) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	return a.packets.read(b)
+}
+
+// WriteTo implements net.PacketConn, writing b to peer with addr.
+//
+// Permission for peer IP is created or refreshed on demand. The
+// ChannelData message is used if there is bound Connection to addr,
+// otherwise Send indication is used.
+func (a *Allocation) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	peer, err := peerAddress(addr)
+	if err != nil {
+		return 0, err
+	}
+	p, err := a.permission(peer.IP)
+	if err != nil {
+		return 0, err
+	}
+	if c := p.connection(peer); c != nil {
+		return c.Write(b)
+	}
+	return a.client.sendData(b, &peer)
+}
+
+// LocalAddr is relayed address from TURN server.
+func (a *Allocation) LocalAddr() net.Addr {
+	return turn.Addr(a.Relayed())
+}
+
+// SetDeadline implements net.PacketConn. Only read deadline is supported.
+func (a *Allocation) SetDeadline(t time.Time) error {
+	return a.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+func (a *Allocation) SetReadDeadline(t time.Time) error {
+	a.packets.setReadDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn. Writes are not blocking,
+// so write deadline is ignored.
+func (a *Allocation) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// handlePacket passes data from peer that has no Connection to ReadFrom
+// of permission, AcceptUDP or ReadFrom of allocation.
+func (a *Allocation) handlePacket(data []byte, addr turn.Addr) {
+	if p := a.findPermission(addr.IP); p != nil {
+		if p.handlePacket(data, addr) || a.handleAccept(p, data, addr) {
+			return
+		}
+	}
+	if !a.packets.push(data, addr) {
+		atomic.AddUint64(&a.client.stats.droppedData, 1)
+		a.log.Debug("dropped packet", zap.Stringer("addr", addr))
+	}
+}
+
+// acceptBacklog is maximum count of connections pending AcceptUDP.
+const acceptBacklog = 16
+
+// AcceptUDP waits for data from new peer and returns Connection to it.
+//
+// After first AcceptUDP call, data from peer port that is permitted but
+// has no Connection creates new Connection, which is returned by AcceptUDP
+// with that data available for Read. Connections that are not accepted in
+// time are dropped. Returns ErrClosed if allocation is closed.
+func (a *Allocation) AcceptUDP() (*Connection, error) {
+	a.client.mux.Lock()
+	if a.accepted == nil {
+		a.accepted = make(chan *Connection, acceptBacklog)
+	}
+	accepted := a.accepted
+	a.client.mux.Unlock()
+	select {
+	case <-a.ctx.Done():
+		return nil, ErrClosed
+	default:
+	}
+	select {
+	case c := <-accepted:
+		return c, nil
+	case <-a.ctx.Done():
+		return nil, ErrClosed
+	}
+}
+
+// handleAccept creates Connection for AcceptUDP from peer addr in p,
+// returning false if AcceptUDP is not used.
+func (a *Allocation) handleAccept(p *Permission, data []byte, addr turn.Addr) bool {
+	a.client.mux.Lock()
+	defer a.client.mux.Unlock()
+	if a.accepted == nil {
+		return false
+	}
+	c := p.newConnection(turn.PeerAddress(addr))
+	c.packets.push(data, addr)
+	select {
+	case a.accepted <- c:
+		p.conn = append(p.conn, c)
+	default:
+		a.log.Warn("accept backlog is full, dropping connection", zap.Stringer("peer", addr))
+	}
+	return true
+}
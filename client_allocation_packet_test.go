@@ -0,0 +1,238 @@
+package turnc
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+
+	"gortc.io/turnc/internal/testutil"
+)
+
+func TestAllocation_PacketConn(t *testing.T) {
+	var _ net.PacketConn = &Allocation{}
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	connL, connR := net.Pipe()
+	defer mustClose(t, connL)
+	stunClient := &testSTUN{}
+	c, createErr := New(Options{
+		Log:             zap.New(core),
+		Conn:            connR, // should not be used
+		STUN:            stunClient,
+		RefreshDisabled: true,
+	})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
+				&turn.RelayedAddress{
+					Port: 1113,
+					IP:   net.IPv4(127, 0, 0, 2),
+				},
+				stun.Fingerprint,
+			),
+		})
+		return nil
+	}
+	a, allocErr := c.Allocate()
+	if allocErr != nil {
+		t.Fatal(allocErr)
+	}
+	if !turn.Addr(a.relayed).Equal(a.LocalAddr().(turn.Addr)) {
+		t.Errorf("unexpected local addr: %s", a.LocalAddr())
+	}
+	var (
+		mux         sync.Mutex
+		permissions int
+		sent        []turn.PeerAddress
+	)
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		switch m.Type {
+		case stun.NewType(stun.MethodCreatePermission, stun.ClassRequest):
+			mux.Lock()
+			permissions++
+			mux.Unlock()
+		case stun.NewType(stun.MethodRefresh, stun.ClassRequest):
+			// Deallocation on close.
+		default:
+			t.Errorf("bad request type: %s", m.Type)
+		}
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+				stun.Fingerprint,
+			),
+		})
+		return nil
+	}
+	stunClient.indicate = func(m *stun.Message) error {
+		var (
+			data turn.Data
+			peer turn.PeerAddress
+		)
+		if err := m.Parse(&data, &peer); err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(data, []byte("hello")) {
+			t.Errorf("unexpected data: %q", data)
+		}
+		mux.Lock()
+		sent = append(sent, peer)
+		mux.Unlock()
+		return nil
+	}
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 1001}
+	for _, addr := range []net.Addr{
+		peer,
+		turn.Addr{IP: peer.IP, Port: 1002},
+	} {
+		if _, err := a.WriteTo([]byte("hello"), addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if permissions != 1 {
+		t.Errorf("unexpected permission requests count: %d", permissions)
+	}
+	if len(sent) != 2 || sent[1].Port != 1002 {
+		t.Errorf("unexpected sent: %v", sent)
+	}
+
+	// Data from peer without Connection.
+	c.stunHandler(stun.Event{
+		Message: stun.MustBuild(stun.TransactionID, dataIndication,
+			turn.Data("world"), &turn.PeerAddress{IP: peer.IP, Port: peer.Port},
+		),
+	})
+	buf := make([]byte, 1024)
+	n, addr, err := a.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], []byte("world")) {
+		t.Errorf("unexpected data: %q", buf[:n])
+	}
+	if !addr.(turn.Addr).Equal(turn.Addr{IP: peer.IP, Port: peer.Port}) {
+		t.Errorf("unexpected addr: %s", addr)
+	}
+	if err = a.SetDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = a.ReadFrom(buf); err == nil {
+		t.Error("should timeout")
+	}
+	testutil.EnsureNoErrors(t, logs)
+	if err = a.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, _, err = a.ReadFrom(buf); err != ErrClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAllocation_AcceptUDP(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	connL, connR := net.Pipe()
+	defer mustClose(t, connL)
+	stunClient := &testSTUN{}
+	c, createErr := New(Options{
+		Log:             zap.New(core),
+		Conn:            connR, // should not be used
+		STUN:            stunClient,
+		RefreshDisabled: true,
+	})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+				&turn.RelayedAddress{
+					Port: 1113,
+					IP:   net.IPv4(127, 0, 0, 2),
+				},
+				stun.Fingerprint,
+			),
+		})
+		return nil
+	}
+	a, allocErr := c.Allocate()
+	if allocErr != nil {
+		t.Fatal(allocErr)
+	}
+	if _, err := a.Create(net.IPv4(127, 0, 0, 3)); err != nil {
+		t.Fatal(err)
+	}
+	indicate := func(port int, data string) {
+		c.stunHandler(stun.Event{
+			Message: stun.MustBuild(stun.TransactionID, dataIndication,
+				turn.Data(data), &turn.PeerAddress{IP: net.IPv4(127, 0, 0, 3), Port: port},
+			),
+		})
+	}
+	// Not accepting yet, so passing to ReadFrom.
+	indicate(1001, "hello")
+	buf := make([]byte, 1024)
+	if _, _, err := a.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *Connection)
+	go func() {
+		conn, err := a.AcceptUDP()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	for {
+		c.mux.RLock()
+		accepting := a.accepted != nil
+		c.mux.RUnlock()
+		if accepting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	indicate(1001, "hello")
+	var conn *Connection
+	select {
+	case conn = <-accepted:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out")
+	}
+	if conn.RemoteAddr().(turn.Addr).Port != 1001 {
+		t.Errorf("unexpected remote addr: %s", conn.RemoteAddr())
+	}
+	go indicate(1001, "world")
+	for _, expected := range []string{"hello", "world"} {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != expected {
+			t.Errorf("unexpected data %q, expected %q", buf[:n], expected)
+		}
+	}
+	testutil.EnsureNoErrors(t, logs)
+	for port := 2000; port <= 2000+acceptBacklog; port++ {
+		indicate(port, "hello")
+	}
+	if logs.FilterMessage("accept backlog is full, dropping connection").Len() != 1 {
+		t.Error("connection should be dropped")
+	}
+	if err := a.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := a.AcceptUDP(); err != ErrClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
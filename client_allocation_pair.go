@@ -0,0 +1,51 @@
+package turnc
+
+import (
+	"errors"
+
+	"go.uber.org/zap"
+)
+
+// ReservationToken returns token for the reserved next-higher port if
+// allocation was created with AllocateOptions.ReservePort, or nil.
+func (a *Allocation) ReservationToken() []byte {
+	return append([]byte(nil), a.token...)
+}
+
+// errNoReservationToken means that server has not returned reservation
+// token for allocation with ReservePort.
+var errNoReservationToken = errors.New("no reservation token in allocate response")
+
+// AllocatePair creates allocations with adjacent even and odd relayed
+// ports, as expected for RTP and RTCP (RFC 3550 Section 11).
+//
+// The rtp client allocates the even port, reserving the next-higher one,
+// which is then allocated by rtcp client with reservation token. Clients
+// should use different connections, because each allocation is bound to
+// its own 5-tuple.
+func AllocatePair(rtp, rtcp *Client, o AllocateOptions) (rtpAlloc, rtcpAlloc *Allocation, err error) {
+	o.EvenPort = true
+	o.ReservePort = true
+	o.ReservationToken = nil
+	rtpAlloc, err = rtp.AllocateWithOptions(o)
+	if err != nil {
+		return nil, nil, err
+	}
+	token := rtpAlloc.ReservationToken()
+	if len(token) == 0 {
+		closeLogged(rtp.log, "failed to close allocation", rtpAlloc)
+		return nil, nil, errNoReservationToken
+	}
+	rtcpAlloc, err = rtcp.AllocateWithOptions(AllocateOptions{
+		Transport:        o.Transport,
+		ReservationToken: token,
+	})
+	if err != nil {
+		closeLogged(rtp.log, "failed to close allocation", rtpAlloc)
+		return nil, nil, err
+	}
+	rtp.log.Debug("allocated pair",
+		zap.Stringer("rtp", rtpAlloc.Relayed()), zap.Stringer("rtcp", rtcpAlloc.Relayed()),
+	)
+	return rtpAlloc, rtcpAlloc, nil
+}
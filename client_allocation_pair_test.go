@@ -0,0 +1,103 @@
+package turnc
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+
+	"gortc.io/turnc/internal/testutil"
+)
+
+func TestAllocatePair(t *testing.T) {
+	token := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	respond := func(m *stun.Message, f func(e stun.Event), port int, setters ...stun.Setter) {
+		setters = append([]stun.Setter{
+			m, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
+			&turn.RelayedAddress{IP: net.IPv4(127, 0, 0, 2), Port: port},
+		}, setters...)
+		f(stun.Event{
+			Message: stun.MustBuild(append(setters, stun.Fingerprint)...),
+		})
+	}
+	t.Run("Ok", func(t *testing.T) {
+		core, logs := observer.New(zapcore.DebugLevel)
+		rtp, rtpSTUN := newTestClient(t, Options{Log: zap.New(core)})
+		rtcp, rtcpSTUN := newTestClient(t, Options{Log: zap.New(core)})
+		rtpSTUN.do = func(m *stun.Message, f func(e stun.Event)) error {
+			var evenPort turn.EvenPort
+			if err := evenPort.GetFrom(m); err != nil {
+				t.Error(err)
+			}
+			if !evenPort.ReservePort {
+				t.Error("R bit not set")
+			}
+			respond(m, f, 50000, turn.ReservationToken(token))
+			return nil
+		}
+		rtcpSTUN.do = func(m *stun.Message, f func(e stun.Event)) error {
+			if m.Contains(stun.AttrEvenPort) {
+				t.Error("unexpected EVEN-PORT")
+			}
+			var got turn.ReservationToken
+			if err := got.GetFrom(m); err != nil {
+				t.Error(err)
+			}
+			if !bytes.Equal(got, token) {
+				t.Errorf("unexpected token: %x", got)
+			}
+			respond(m, f, 50001)
+			return nil
+		}
+		rtpAlloc, rtcpAlloc, err := AllocatePair(rtp, rtcp, AllocateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rtpAlloc.Relayed().Port != 50000 || rtcpAlloc.Relayed().Port != 50001 {
+			t.Errorf("unexpected ports: %s, %s", rtpAlloc.Relayed(), rtcpAlloc.Relayed())
+		}
+		if !bytes.Equal(rtpAlloc.ReservationToken(), token) {
+			t.Errorf("unexpected token: %x", rtpAlloc.ReservationToken())
+		}
+		if rtcpAlloc.ReservationToken() != nil {
+			t.Error("unexpected rtcp token")
+		}
+		testutil.EnsureNoErrors(t, logs)
+	})
+	t.Run("NoToken", func(t *testing.T) {
+		rtp, rtpSTUN := newTestClient(t, Options{})
+		rtcp, rtcpSTUN := newTestClient(t, Options{})
+		rtpSTUN.do = func(m *stun.Message, f func(e stun.Event)) error {
+			respond(m, f, 50000)
+			return nil
+		}
+		rtcpSTUN.do = func(m *stun.Message, f func(e stun.Event)) error {
+			t.Error("should not be called")
+			return nil
+		}
+		if _, _, err := AllocatePair(rtp, rtcp, AllocateOptions{}); err != errNoReservationToken {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("ConflictingOptions", func(t *testing.T) {
+		c, stunClient := newTestClient(t, Options{})
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			t.Error("should not be called")
+			return nil
+		}
+		for _, o := range []AllocateOptions{
+			{ReservationToken: token, EvenPort: true},
+			{ReservationToken: token, Family: FamilyIPv6},
+		} {
+			if _, err := c.AllocateWithOptions(o); err != errReservationToken {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+	})
+}
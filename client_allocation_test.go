@@ -476,3 +476,212 @@ func TestClient_Allocate(t *testing.T) {
 		testutil.EnsureNoErrors(t, logs)
 	})
 }
+
+func TestAllocation_Close(t *testing.T) {
+	t.Run("StaleNonce", func(t *testing.T) {
+		core, logs := observer.New(zapcore.DebugLevel)
+		_, stunClient, a := newTestAllocation(t, Options{Log: zap.New(core)})
+		p, permErr := a.Create(net.IPv4(127, 0, 0, 3))
+		if permErr != nil {
+			t.Fatal(permErr)
+		}
+		conn, connErr := p.CreateUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 1001})
+		if connErr != nil {
+			t.Fatal(connErr)
+		}
+		var requests int
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			if m.Type != stun.NewType(stun.MethodRefresh, stun.ClassRequest) {
+				t.Errorf("bad request type: %s", m.Type)
+			}
+			var lifetime turn.Lifetime
+			if err := lifetime.GetFrom(m); err != nil {
+				t.Error(err)
+			}
+			if lifetime.Duration != 0 {
+				t.Errorf("unexpected lifetime: %s", lifetime)
+			}
+			requests++
+			if requests == 1 {
+				f(stun.Event{
+					Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+						stun.CodeStaleNonce, stun.NewNonce("nonce"), stun.Fingerprint,
+					),
+				})
+				return nil
+			}
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+					stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if requests != 2 {
+			t.Errorf("unexpected requests count: %d", requests)
+		}
+		if _, err := conn.Read(make([]byte, 10)); err == nil {
+			t.Error("connection should be closed")
+		}
+		if len(a.perms) != 0 || len(p.conn) != 0 {
+			t.Error("permissions and connections should be removed")
+		}
+		if err := a.Close(); err != nil {
+			t.Error(err)
+		}
+		if requests != 2 {
+			t.Error("second close should be no-op")
+		}
+		testutil.EnsureNoErrors(t, logs)
+	})
+	t.Run("Mismatch", func(t *testing.T) {
+		_, stunClient, a := newTestAllocation(t, Options{})
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+					stun.CodeAllocMismatch, stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		if err := a.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("Error", func(t *testing.T) {
+		_, stunClient, a := newTestAllocation(t, Options{})
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+					stun.CodeServerError, stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		if err := a.Close(); err == nil {
+			t.Error("should error")
+		}
+	})
+	t.Run("ClientManualClose", func(t *testing.T) {
+		c, stunClient, _ := newTestAllocation(t, Options{ConnManualClose: true})
+		deleted := false
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			var lifetime turn.Lifetime
+			if err := lifetime.GetFrom(m); err == nil && lifetime.Duration == 0 {
+				deleted = true
+			}
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+					stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		if err := c.Close(); err != nil {
+			t.Error(err)
+		}
+		if !deleted {
+			t.Error("allocation should be deleted")
+		}
+	})
+}
+
+func TestAllocation_CreateMany(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	connL, connR := net.Pipe()
+	defer mustClose(t, connL)
+	stunClient := &testSTUN{}
+	c, createErr := New(Options{
+		Log:             zap.New(core),
+		Conn:            connR, // should not be used
+		STUN:            stunClient,
+		RefreshDisabled: true,
+	})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
+				&turn.RelayedAddress{
+					Port: 1113,
+					IP:   net.IPv4(127, 0, 0, 2),
+				},
+				stun.Fingerprint,
+			),
+		})
+		return nil
+	}
+	a, allocErr := c.Allocate()
+	if allocErr != nil {
+		t.Fatal(allocErr)
+	}
+	var requests [][]net.IP
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		if m.Type != stun.NewType(stun.MethodCreatePermission, stun.ClassRequest) {
+			t.Errorf("bad request type: %s", m.Type)
+		}
+		var ips []net.IP
+		for _, attr := range m.Attributes {
+			if attr.Type != stun.AttrXORPeerAddress {
+				continue
+			}
+			single := stun.New()
+			single.TransactionID = m.TransactionID
+			single.WriteHeader()
+			single.Add(attr.Type, attr.Value)
+			var peer turn.PeerAddress
+			if err := peer.GetFrom(single); err != nil {
+				t.Error(err)
+			}
+			ips = append(ips, peer.IP)
+		}
+		requests = append(requests, ips)
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+				stun.Fingerprint,
+			),
+		})
+		return nil
+	}
+	ips := make([]net.IP, 0, maxPeersPerRequest+8)
+	for i := 0; i < cap(ips); i++ {
+		ips = append(ips, net.IPv4(10, 0, 0, byte(i+1)))
+	}
+	perms, err := a.CreateMany(ips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 || len(requests[0]) != maxPeersPerRequest || len(requests[1]) != 8 {
+		t.Fatalf("unexpected requests: %v", requests)
+	}
+	if !requests[1][7].Equal(ips[len(ips)-1]) {
+		t.Errorf("unexpected last peer: %s", requests[1][7])
+	}
+	if len(perms) != len(ips) || len(a.perms) != len(ips) {
+		t.Fatalf("unexpected permissions count: %d", len(perms))
+	}
+	for i := range perms {
+		if !perms[i].ip.Equal(ips[i]) {
+			t.Errorf("[%d] unexpected permission ip: %s", i, perms[i].ip)
+		}
+	}
+	if perms, err = a.CreateMany(nil); err != nil || perms != nil {
+		t.Errorf("unexpected result for no ips: %v, %v", perms, err)
+	}
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+				stun.CodeForbidden, stun.Fingerprint,
+			),
+		})
+		return nil
+	}
+	if _, err = a.CreateMany(ips[:2]); !errors.Is(err, ErrForbidden) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	testutil.EnsureNoErrors(t, logs)
+}
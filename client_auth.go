@@ -0,0 +1,386 @@
+package turnc
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gortc.io/stun"
+)
+
+// Credentials are long-term credentials, RFC 5389 Section 10.2.
+type Credentials struct {
+	Username string
+	Password string
+	// Expires is time when credentials are no longer valid, zero value
+	// means that they do not expire. Expiring credentials are requested
+	// from provider again before expiration, see ErrUsernameChanged.
+	Expires time.Time
+}
+
+// credentialsRenewBefore is duration before credentials expiration when
+// they are requested from provider again.
+const credentialsRenewBefore = time.Minute
+
+// CredentialProvider provides long-term credentials for realm.
+//
+// Provider is called on each 401 (Unauthorized) response, including
+// responses to Refresh, CreatePermission and ChannelBind requests, and
+// when server changes realm, so password can be rotated without dropping
+// allocation. Username can't be changed during allocation, see
+// ErrUsernameChanged.
+type CredentialProvider interface {
+	Credentials(realm string) (Credentials, error)
+}
+
+// CredentialProviderFunc is adapter to use function as CredentialProvider.
+type CredentialProviderFunc func(realm string) (Credentials, error)
+
+// Credentials calls f(realm).
+func (f CredentialProviderFunc) Credentials(realm string) (Credentials, error) {
+	return f(realm)
+}
+
+// StaticCredentials returns CredentialProvider with fixed credentials for
+// any realm.
+func StaticCredentials(username, password string) CredentialProvider {
+	return CredentialProviderFunc(func(realm string) (Credentials, error) {
+		return Credentials{Username: username, Password: password}, nil
+	})
+}
+
+// longTermAuth contains attributes of long-term credentials mechanism or
+// third-party authorization, added to requests as stun.Setter. Zero value
+// means no authentication.
+type longTermAuth struct {
+	username   stun.Username
+	realm      stun.Realm
+	nonce      stun.Nonce
+	token      accessToken // only for third-party authorization
+	authServer string      // THIRD-PARTY-AUTHORIZATION of server
+	integrity  stun.MessageIntegrity
+	expires    time.Time
+	// RFC 8489 security features, see setKey.
+	integritySHA256 bool // integrity is key for MESSAGE-INTEGRITY-SHA256
+	algorithm       passwordAlgorithm
+	algorithms      passwordAlgorithms
+	userHash        userHash // used instead of username if not empty
+}
+
+// expiring reports whether credentials should be renewed at now.
+func (l longTermAuth) expiring(now time.Time) bool {
+	if len(l.integrity) == 0 || l.expires.IsZero() {
+		return false
+	}
+	return now.Add(credentialsRenewBefore).After(l.expires)
+}
+
+// AddTo adds USERNAME (or USERHASH), REALM, NONCE, PASSWORD-ALGORITHMS,
+// PASSWORD-ALGORITHM, ACCESS-TOKEN and MESSAGE-INTEGRITY (or
+// MESSAGE-INTEGRITY-SHA256) to message, skipping unused attributes.
+func (l longTermAuth) AddTo(m *stun.Message) error {
+	if len(l.integrity) == 0 {
+		return nil
+	}
+	setters := []stun.Setter{l.username}
+	if len(l.userHash) > 0 {
+		setters[0] = l.userHash
+	}
+	if len(l.realm) > 0 {
+		setters = append(setters, l.realm)
+	}
+	if len(l.nonce) > 0 {
+		setters = append(setters, l.nonce)
+	}
+	if len(l.algorithms) > 0 {
+		setters = append(setters, l.algorithms, l.algorithm)
+	}
+	if len(l.token) > 0 {
+		setters = append(setters, l.token)
+	}
+	if l.integritySHA256 {
+		setters = append(setters, messageIntegritySHA256(l.integrity))
+	} else {
+		setters = append(setters, l.integrity)
+	}
+	for _, s := range setters {
+		if err := s.AddTo(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authenticate returns long-term credentials for realm and nonce from
+// 401 (Unauthorized) or 438 (Stale Nonce) response, requesting username
+// and password from credential provider, or access token from token
+// provider if third-party authorization is used.
+func (c *Client) authenticate(res *stun.Message) (longTermAuth, error) {
+	var (
+		realm stun.Realm
+		nonce stun.Nonce
+	)
+	if c.tokens != nil {
+		// Realm and nonce are optional for third-party authorization.
+		if err := nonce.GetFrom(res); err != nil && err != stun.ErrAttributeNotFound {
+			return longTermAuth{}, err
+		}
+		if err := realm.GetFrom(res); err != nil && err != stun.ErrAttributeNotFound {
+			return longTermAuth{}, err
+		}
+		server, err := res.Get(attrThirdPartyAuthorization)
+		if err != nil && err != stun.ErrAttributeNotFound {
+			return longTermAuth{}, err
+		}
+		return c.tokenAuth(string(server), realm, nonce)
+	}
+	if err := nonce.GetFrom(res); err != nil {
+		return longTermAuth{}, err
+	}
+	if err := realm.GetFrom(res); err != nil {
+		return longTermAuth{}, err
+	}
+	algorithms, err := res.Get(attrPasswordAlgorithms)
+	if err != nil && err != stun.ErrAttributeNotFound {
+		return longTermAuth{}, err
+	}
+	return c.longTermAuth(realm, nonce, algorithms)
+}
+
+// longTermAuth requests credentials for realm from credential provider,
+// returning long-term credentials with provided realm, nonce and
+// PASSWORD-ALGORITHMS of server.
+func (c *Client) longTermAuth(realm stun.Realm, nonce stun.Nonce, algorithms passwordAlgorithms) (longTermAuth, error) {
+	credentials, err := c.credentials.Credentials(realm.String())
+	if err != nil {
+		return longTermAuth{}, err
+	}
+	auth := longTermAuth{
+		username: stun.NewUsername(credentials.Username),
+		realm:    append(stun.Realm(nil), realm...),
+		nonce:    append(stun.Nonce(nil), nonce...),
+		expires:  credentials.Expires,
+	}
+	auth.setKey(credentials, algorithms, c.userHash)
+	return auth, nil
+}
+
+// ErrUsernameChanged means that credential provider returned different
+// username for realm of allocation after current credentials expired or
+// were rejected by server. Username can't be changed during allocation,
+// RFC 5766 Section 4, so new allocation is needed, see Options.Recover.
+// That is the case for TURN REST API credentials, where username contains
+// expiration time.
+var ErrUsernameChanged = errors.New("username can't be changed during allocation")
+
+// usernameChanged reports whether renewed long-term credentials have
+// different username for the same realm.
+func usernameChanged(current, renewed longTermAuth) bool {
+	switch {
+	case len(current.integrity) == 0, len(current.token) > 0:
+		// Anonymous allocation or third-party authorization.
+		return false
+	case current.realm.String() != renewed.realm.String():
+		return false
+	}
+	return current.username.String() != renewed.username.String()
+}
+
+// renewAuth requests credentials or access token from provider again if
+// current ones should be renewed at now, keeping realm and nonce. Current
+// credentials are kept if username is changed, returning
+// ErrUsernameChanged.
+func (a *Allocation) renewAuth(now time.Time) error {
+	a.authMux.RLock()
+	auth := a.auth
+	a.authMux.RUnlock()
+	if !auth.expiring(now) {
+		return nil
+	}
+	var (
+		renewed longTermAuth
+		err     error
+	)
+	if a.client.tokens != nil {
+		renewed, err = a.client.tokenAuth(auth.authServer, auth.realm, auth.nonce)
+	} else {
+		renewed, err = a.client.longTermAuth(auth.realm, auth.nonce, auth.algorithms)
+	}
+	if err != nil {
+		a.log.Warn("failed to renew credentials", zap.Error(err))
+		return nil
+	}
+	if usernameChanged(auth, renewed) {
+		return ErrUsernameChanged
+	}
+	a.authMux.Lock()
+	a.auth = renewed
+	a.authMux.Unlock()
+	a.log.Debug("credentials renewed")
+	return nil
+}
+
+// currentAuth returns long-term credentials for requests in the
+// allocation, which are zero for anonymous allocation. Expiring
+// credentials are renewed, and ones with changed username are used until
+// expiration.
+func (a *Allocation) currentAuth() (longTermAuth, error) {
+	now := time.Now()
+	err := a.renewAuth(now)
+	a.authMux.RLock()
+	auth := a.auth
+	a.authMux.RUnlock()
+	if err != nil && auth.expires.After(now) {
+		err = nil
+	}
+	return auth, err
+}
+
+// unprotectedErrors are error codes of responses that can be sent by
+// server without MESSAGE-INTEGRITY, because request can't be
+// authenticated, RFC 8489 Section 9.2.5.
+var unprotectedErrors = map[stun.ErrorCode]bool{
+	stun.CodeBadRequest:       true,
+	stun.CodeUnauthorized:     true,
+	stun.CodeUnknownAttribute: true,
+	stun.CodeStaleNonce:       true,
+}
+
+// check verifies FINGERPRINT (if present) and MESSAGE-INTEGRITY or
+// MESSAGE-INTEGRITY-SHA256 of response to request that is authenticated
+// with l. Integrity is not required for error responses with codes from
+// unprotectedErrors.
+func (l longTermAuth) check(res *stun.Message) error {
+	if len(l.integrity) == 0 {
+		return nil
+	}
+	if res.Contains(stun.AttrFingerprint) {
+		if err := stun.Fingerprint.Check(res); err != nil {
+			return err
+		}
+	}
+	integrityAttr := stun.AttrMessageIntegrity
+	if l.integritySHA256 {
+		integrityAttr = attrMessageIntegritySHA256
+	}
+	if res.Type.Class == stun.ClassErrorResponse && !res.Contains(integrityAttr) {
+		var code stun.ErrorCodeAttribute
+		if err := code.GetFrom(res); err == nil && unprotectedErrors[code.Code] {
+			return nil
+		}
+	}
+	if l.integritySHA256 {
+		return messageIntegritySHA256(l.integrity).Check(res)
+	}
+	return l.integrity.Check(res)
+}
+
+// checkResponseIntegrity verifies response to request that is
+// authenticated with auth, returning *IntegrityError and counting
+// failure if verification failed.
+func (c *Client) checkResponseIntegrity(auth longTermAuth, res *stun.Message) error {
+	err := auth.check(res)
+	if err == nil {
+		return nil
+	}
+	atomic.AddUint64(&c.stats.integrityFailures, 1)
+	c.log.Warn("response integrity check failed",
+		zap.Stringer("type", res.Type), zap.Error(err),
+	)
+	return &IntegrityError{Method: res.Type.Method, Err: err}
+}
+
+// updateAuth updates nonce if res is stale nonce error response, or
+// credentials if res is unauthorized error response or realm is changed,
+// returning true if request should be retried. Rejected credentials are
+// not retried if username is changed, returning ErrUsernameChanged.
+func (a *Allocation) updateAuth(res *stun.Message) (bool, error) {
+	if res.Type.Class != stun.ClassErrorResponse {
+		return false, nil
+	}
+	var (
+		code  stun.ErrorCodeAttribute
+		nonce stun.Nonce
+		realm stun.Realm
+	)
+	if err := code.GetFrom(res); err != nil {
+		return false, nil
+	}
+	if code.Code != stun.CodeStaleNonce && code.Code != stun.CodeUnauthorized {
+		return false, nil
+	}
+	a.authMux.RLock()
+	realmChanged := realm.GetFrom(res) == nil && realm.String() != a.auth.realm.String()
+	a.authMux.RUnlock()
+	if code.Code == stun.CodeUnauthorized || realmChanged {
+		auth, err := a.client.authenticate(res)
+		if err != nil {
+			a.log.Warn("failed to update credentials", zap.Error(err))
+			return false, nil
+		}
+		a.authMux.Lock()
+		defer a.authMux.Unlock()
+		if usernameChanged(a.auth, auth) {
+			return false, ErrUsernameChanged
+		}
+		a.auth = auth
+		a.log.Debug("credentials updated")
+		return true, nil
+	}
+	if err := nonce.GetFrom(res); err != nil {
+		return false, nil
+	}
+	a.authMux.Lock()
+	a.auth.nonce = append(stun.Nonce(nil), nonce...)
+	a.authMux.Unlock()
+	a.log.Debug("nonce updated")
+	return true, nil
+}
+
+// do performs request transaction with provided method and attributes,
+// applying long-term credentials of allocation.
+//
+// On stale nonce error (438), the nonce of allocation is updated, so it is
+// used by all subsequent requests, and transaction is retried once. The
+// same is done with new credentials on unauthorized error (401).
+// Responses to authenticated requests are verified by checkResponseIntegrity.
+func (a *Allocation) do(ctx context.Context, method stun.Method, attrs []stun.Setter, res *stun.Message) error {
+	for attempt := 0; ; attempt++ {
+		req := stun.New()
+		req.TransactionID = stun.NewTransactionID()
+		req.Type = stun.NewType(method, stun.ClassRequest)
+		req.WriteHeader()
+		auth, authErr := a.currentAuth()
+		if authErr != nil {
+			return authErr
+		}
+		setters := make([]stun.Setter, 0, len(attrs)+2)
+		setters = append(setters, attrs...)
+		setters = append(setters, auth, stun.Fingerprint)
+		for _, s := range setters {
+			if setErr := s.AddTo(req); setErr != nil {
+				return setErr
+			}
+		}
+		res.Reset()
+		if doErr := a.client.doContext(ctx, req, res); doErr != nil {
+			return doErr
+		}
+		if err := a.client.checkResponseIntegrity(auth, res); err != nil {
+			return err
+		}
+		if attempt == 0 {
+			retry, err := a.updateAuth(res)
+			if err != nil {
+				return err
+			}
+			if retry {
+				continue
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,221 @@
+package turnc
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+
+	"gortc.io/stun"
+)
+
+// Attributes of STUN security features, RFC 8489 Section 18.3.
+const (
+	attrMessageIntegritySHA256 stun.AttrType = 0x001C // MESSAGE-INTEGRITY-SHA256
+	attrPasswordAlgorithm      stun.AttrType = 0x001D // PASSWORD-ALGORITHM
+	attrUserHash               stun.AttrType = 0x001E // USERHASH
+	attrPasswordAlgorithms     stun.AttrType = 0x8002 // PASSWORD-ALGORITHMS
+)
+
+// Security features that are announced by server in NONCE, RFC 8489
+// Section 18.1. Bit 0 is the most significant bit of 24-bit set.
+const (
+	featurePasswordAlgorithms uint32 = 1 << 23
+	featureUsernameAnonymity  uint32 = 1 << 22
+)
+
+// nonceCookie is prefix of nonce that is followed by encoded security
+// features.
+const nonceCookie = "obMatJos2"
+
+// nonceFeatures returns security features from nonce, or zero if nonce
+// has no nonce cookie, e.g. from RFC 5389 server.
+func nonceFeatures(nonce stun.Nonce) uint32 {
+	const encodedLength = 4 // 24 bits in base64
+	if len(nonce) < len(nonceCookie)+encodedLength || string(nonce[:len(nonceCookie)]) != nonceCookie {
+		return 0
+	}
+	b, err := base64.StdEncoding.DecodeString(string(nonce[len(nonceCookie) : len(nonceCookie)+encodedLength]))
+	if err != nil || len(b) != 3 {
+		return 0
+	}
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+// passwordAlgorithm is PASSWORD-ALGORITHM attribute without parameters,
+// RFC 8489 Section 14.12.
+type passwordAlgorithm uint16
+
+// Password algorithms, RFC 8489 Section 18.5.
+const (
+	passwordAlgorithmMD5    passwordAlgorithm = 0x0001
+	passwordAlgorithmSHA256 passwordAlgorithm = 0x0002
+)
+
+// passwordAlgorithmHeaderSize is size of algorithm and parameters length
+// in PASSWORD-ALGORITHM and in each entry of PASSWORD-ALGORITHMS.
+const passwordAlgorithmHeaderSize = 4
+
+// AddTo adds PASSWORD-ALGORITHM to message.
+func (p passwordAlgorithm) AddTo(m *stun.Message) error {
+	v := make([]byte, passwordAlgorithmHeaderSize) // zero parameters length
+	binary.BigEndian.PutUint16(v, uint16(p))
+	m.Add(attrPasswordAlgorithm, v)
+	return nil
+}
+
+// passwordAlgorithms is raw value of PASSWORD-ALGORITHMS attribute,
+// RFC 8489 Section 14.11, which is sent back to server unchanged.
+type passwordAlgorithms []byte
+
+// AddTo adds PASSWORD-ALGORITHMS to message.
+func (p passwordAlgorithms) AddTo(m *stun.Message) error {
+	m.Add(attrPasswordAlgorithms, p)
+	return nil
+}
+
+// contains reports whether algorithm is in list.
+func (p passwordAlgorithms) contains(algorithm passwordAlgorithm) bool {
+	b := []byte(p)
+	for len(b) >= passwordAlgorithmHeaderSize {
+		if passwordAlgorithm(binary.BigEndian.Uint16(b)) == algorithm {
+			return true
+		}
+		// Parameters are padded to 4 bytes.
+		n := passwordAlgorithmHeaderSize + (int(binary.BigEndian.Uint16(b[2:]))+3)&^3
+		if n > len(b) {
+			return false
+		}
+		b = b[n:]
+	}
+	return false
+}
+
+// userHash is USERHASH attribute, RFC 8489 Section 14.4.
+type userHash []byte
+
+// newUserHash returns USERHASH for username and realm.
+func newUserHash(username, realm string) userHash {
+	h := sha256.Sum256([]byte(username + ":" + realm))
+	return h[:]
+}
+
+// AddTo adds USERHASH to message.
+func (u userHash) AddTo(m *stun.Message) error {
+	m.Add(attrUserHash, u)
+	return nil
+}
+
+// errFingerprintBeforeIntegrity means that FINGERPRINT was added before
+// MESSAGE-INTEGRITY-SHA256.
+var errFingerprintBeforeIntegrity = errors.New("FINGERPRINT before MESSAGE-INTEGRITY-SHA256 attribute")
+
+// attributeHeaderSize is size of STUN attribute type and length.
+const attributeHeaderSize = 4
+
+// messageIntegritySHA256 is key for MESSAGE-INTEGRITY-SHA256 attribute,
+// RFC 8489 Section 14.6, which is HMAC-SHA256 of message.
+type messageIntegritySHA256 []byte
+
+// AddTo adds MESSAGE-INTEGRITY-SHA256 to message. Should be added
+// after all attributes except FINGERPRINT.
+func (i messageIntegritySHA256) AddTo(m *stun.Message) error {
+	for _, a := range m.Attributes {
+		if a.Type == stun.AttrFingerprint {
+			return errFingerprintBeforeIntegrity
+		}
+	}
+	// Length in header should include the attribute.
+	length := m.Length
+	m.Length += sha256.Size + attributeHeaderSize
+	m.WriteLength()
+	mac := hmac.New(sha256.New, i)
+	_, _ = mac.Write(m.Raw) // hash.Hash never returns error
+	m.Length = length
+	m.Add(attrMessageIntegritySHA256, mac.Sum(nil))
+	return nil
+}
+
+// minIntegritySHA256Size is minimum length of truncated
+// MESSAGE-INTEGRITY-SHA256 value, RFC 8489 Section 14.6.
+const minIntegritySHA256Size = 16
+
+// Check checks MESSAGE-INTEGRITY-SHA256 of message, returning
+// stun.ErrIntegrityMismatch on mismatch. Truncated values of at least
+// 16 bytes are allowed.
+func (i messageIntegritySHA256) Check(m *stun.Message) error {
+	v, err := m.Get(attrMessageIntegritySHA256)
+	if err != nil {
+		return err
+	}
+	if len(v) < minIntegritySHA256Size || len(v) > sha256.Size {
+		return stun.ErrIntegrityMismatch
+	}
+	// Length in header is adjusted to exclude attributes after
+	// MESSAGE-INTEGRITY-SHA256, like when HMAC was computed.
+	var (
+		length         = m.Length
+		afterIntegrity = false
+		sizeReduced    uint32
+	)
+	for _, a := range m.Attributes {
+		if afterIntegrity {
+			sizeReduced += attributeHeaderSize + (uint32(a.Length)+3)&^3
+		}
+		if a.Type == attrMessageIntegritySHA256 {
+			afterIntegrity = true
+		}
+	}
+	m.Length -= sizeReduced
+	m.WriteLength()
+	end := stunHeaderSize + m.Length - attributeHeaderSize - uint32((len(v)+3)&^3)
+	mac := hmac.New(sha256.New, i)
+	_, _ = mac.Write(m.Raw[:end]) // hash.Hash never returns error
+	m.Length = length
+	m.WriteLength()
+	if !hmac.Equal(v, mac.Sum(nil)[:len(v)]) {
+		return stun.ErrIntegrityMismatch
+	}
+	return nil
+}
+
+// setKey sets integrity key and attributes of security features that
+// are announced by server in nonce, RFC 8489 Section 9.2, falling back
+// to RFC 5389 long-term credentials if server does not support them.
+//
+// SHA-256 password algorithm is preferred if offered by server, and
+// MESSAGE-INTEGRITY-SHA256 is used with any algorithm. If useHash is set
+// and server supports username anonymity, USERHASH is used instead of
+// USERNAME. Passwords are not processed with OpaqueString profile.
+func (l *longTermAuth) setKey(credentials Credentials, algorithms passwordAlgorithms, useHash bool) {
+	var (
+		features = nonceFeatures(l.nonce)
+		key      = credentials.Username + ":" + l.realm.String() + ":" + credentials.Password
+	)
+	switch {
+	case features&featurePasswordAlgorithms == 0:
+		// RFC 5389 server.
+		l.integrity = stun.NewLongTermIntegrity(credentials.Username, l.realm.String(), credentials.Password)
+	case algorithms.contains(passwordAlgorithmSHA256):
+		h := sha256.Sum256([]byte(key))
+		l.setAlgorithm(passwordAlgorithmSHA256, algorithms, h[:])
+	case algorithms.contains(passwordAlgorithmMD5):
+		h := md5.Sum([]byte(key))
+		l.setAlgorithm(passwordAlgorithmMD5, algorithms, h[:])
+	default:
+		// No supported algorithms, server should reject request.
+		l.integrity = stun.NewLongTermIntegrity(credentials.Username, l.realm.String(), credentials.Password)
+	}
+	if useHash && features&featureUsernameAnonymity != 0 {
+		l.userHash = newUserHash(credentials.Username, l.realm.String())
+	}
+}
+
+func (l *longTermAuth) setAlgorithm(algorithm passwordAlgorithm, algorithms passwordAlgorithms, key []byte) {
+	l.integrity = key
+	l.integritySHA256 = true
+	l.algorithm = algorithm
+	l.algorithms = append(passwordAlgorithms(nil), algorithms...)
+}
@@ -0,0 +1,205 @@
+package turnc
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+)
+
+func TestNonceFeatures(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		nonce    string
+		features uint32
+	}{
+		{name: "Classic", nonce: "f//499k954d6OL34oL9FSTvy64sA"},
+		{name: "Short", nonce: "obMatJos2gA"},
+		{name: "Invalid", nonce: "obMatJos2!!!!nonce"},
+		{name: "PasswordAlgorithms", nonce: "obMatJos2gAAAnonce", features: featurePasswordAlgorithms},
+		{
+			name: "All", nonce: "obMatJos2wAAAnonce",
+			features: featurePasswordAlgorithms | featureUsernameAnonymity,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if f := nonceFeatures(stun.Nonce(tc.nonce)); f != tc.features {
+				t.Errorf("unexpected features: %x", f)
+			}
+		})
+	}
+}
+
+// newPasswordAlgorithms returns PASSWORD-ALGORITHMS value with algorithms,
+// adding padded parameters of length n to each one.
+func newPasswordAlgorithms(n int, algorithms ...passwordAlgorithm) passwordAlgorithms {
+	var v []byte
+	for _, a := range algorithms {
+		b := make([]byte, 4+(n+3)&^3)
+		binary.BigEndian.PutUint16(b, uint16(a))
+		binary.BigEndian.PutUint16(b[2:], uint16(n))
+		v = append(v, b...)
+	}
+	return v
+}
+
+func TestPasswordAlgorithms_contains(t *testing.T) {
+	p := newPasswordAlgorithms(3, passwordAlgorithmMD5, passwordAlgorithmSHA256)
+	if !p.contains(passwordAlgorithmMD5) || !p.contains(passwordAlgorithmSHA256) {
+		t.Error("should contain both algorithms")
+	}
+	if p.contains(0x0003) {
+		t.Error("should not contain unknown algorithm")
+	}
+	if p[:6].contains(passwordAlgorithmSHA256) {
+		t.Error("should not contain algorithm from truncated value")
+	}
+}
+
+func TestMessageIntegritySHA256(t *testing.T) {
+	i := messageIntegritySHA256("key")
+	m := stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+		stun.NewUsername("user"), i, stun.Fingerprint,
+	)
+	decoded := new(stun.Message)
+	if _, err := decoded.Write(m.Raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Check(decoded); err != nil {
+		t.Error(err)
+	}
+	if err := messageIntegritySHA256("other").Check(decoded); err != stun.ErrIntegrityMismatch {
+		t.Errorf("unexpected error: %v", err)
+	}
+	t.Run("FingerprintBefore", func(t *testing.T) {
+		m := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+		if err := i.AddTo(m); err != errFingerprintBeforeIntegrity {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+// allocateWithFeatures performs allocation with server that announces
+// security features in nonce and password algorithms, calling check for
+// authenticated Allocate request and protecting response with integrity.
+func allocateWithFeatures(
+	t *testing.T, o Options, nonce string, algorithms passwordAlgorithms,
+	integrity stun.Setter, check func(m *stun.Message),
+) {
+	t.Helper()
+	connL, connR := net.Pipe()
+	defer mustClose(t, connL)
+	stunClient := &testSTUN{}
+	o.Conn = connR
+	o.STUN = stunClient
+	o.RefreshDisabled = true
+	o.Username = "user"
+	o.Password = "secret"
+	c, createErr := New(o)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	authenticated := false
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		if _, err := m.Get(stun.AttrNonce); err != nil {
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse),
+					stun.NewRealm("realm"), stun.NewNonce(nonce), algorithms,
+					stun.CodeUnauthorized, stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		authenticated = true
+		check(m)
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
+				&turn.RelayedAddress{
+					Port: 1113,
+					IP:   net.IPv4(127, 0, 0, 2),
+				},
+				integrity, stun.Fingerprint,
+			),
+		})
+		return nil
+	}
+	if _, err := c.Allocate(); err != nil {
+		t.Fatal(err)
+	}
+	if !authenticated {
+		t.Error("no authenticated request")
+	}
+}
+
+func TestClient_AllocateSecurityFeatures(t *testing.T) {
+	both := newPasswordAlgorithms(0, passwordAlgorithmMD5, passwordAlgorithmSHA256)
+	t.Run("SHA256", func(t *testing.T) {
+		key := sha256.Sum256([]byte("user:realm:secret"))
+		allocateWithFeatures(t, Options{}, "obMatJos2gAAAnonce", both, messageIntegritySHA256(key[:]), func(m *stun.Message) {
+			if err := messageIntegritySHA256(key[:]).Check(m); err != nil {
+				t.Errorf("integrity check failed: %v", err)
+			}
+			if m.Contains(stun.AttrMessageIntegrity) {
+				t.Error("unexpected MESSAGE-INTEGRITY")
+			}
+			algorithm, err := m.Get(attrPasswordAlgorithm)
+			if err != nil || binary.BigEndian.Uint16(algorithm) != uint16(passwordAlgorithmSHA256) {
+				t.Errorf("unexpected PASSWORD-ALGORITHM: %x (%v)", algorithm, err)
+			}
+			algorithms, err := m.Get(attrPasswordAlgorithms)
+			if err != nil || string(algorithms) != string(both) {
+				t.Errorf("unexpected PASSWORD-ALGORITHMS: %x (%v)", algorithms, err)
+			}
+			if !m.Contains(stun.AttrUsername) || m.Contains(attrUserHash) {
+				t.Error("USERNAME should be used")
+			}
+		})
+	})
+	t.Run("MD5", func(t *testing.T) {
+		key := md5.Sum([]byte("user:realm:secret"))
+		md5Only := newPasswordAlgorithms(0, passwordAlgorithmMD5)
+		allocateWithFeatures(t, Options{}, "obMatJos2gAAAnonce", md5Only, messageIntegritySHA256(key[:]), func(m *stun.Message) {
+			if err := messageIntegritySHA256(key[:]).Check(m); err != nil {
+				t.Errorf("integrity check failed: %v", err)
+			}
+			algorithm, err := m.Get(attrPasswordAlgorithm)
+			if err != nil || binary.BigEndian.Uint16(algorithm) != uint16(passwordAlgorithmMD5) {
+				t.Errorf("unexpected PASSWORD-ALGORITHM: %x (%v)", algorithm, err)
+			}
+		})
+	})
+	t.Run("UserHash", func(t *testing.T) {
+		key := sha256.Sum256([]byte("user:realm:secret"))
+		hash := sha256.Sum256([]byte("user:realm"))
+		allocateWithFeatures(t, Options{UserHash: true}, "obMatJos2wAAAnonce", both, messageIntegritySHA256(key[:]), func(m *stun.Message) {
+			if err := messageIntegritySHA256(key[:]).Check(m); err != nil {
+				t.Errorf("integrity check failed: %v", err)
+			}
+			if m.Contains(stun.AttrUsername) {
+				t.Error("unexpected USERNAME")
+			}
+			v, err := m.Get(attrUserHash)
+			if err != nil || string(v) != string(hash[:]) {
+				t.Errorf("unexpected USERHASH: %x (%v)", v, err)
+			}
+		})
+	})
+	t.Run("Classic", func(t *testing.T) {
+		integrity := stun.NewLongTermIntegrity("user", "realm", "secret")
+		allocateWithFeatures(t, Options{UserHash: true}, "nonce", both, integrity, func(m *stun.Message) {
+			if err := integrity.Check(m); err != nil {
+				t.Errorf("integrity check failed: %v", err)
+			}
+			if m.Contains(attrMessageIntegritySHA256) || m.Contains(attrPasswordAlgorithm) {
+				t.Error("unexpected RFC 8489 attributes")
+			}
+			if m.Contains(attrUserHash) {
+				t.Error("unexpected USERHASH")
+			}
+		})
+	})
+}
@@ -0,0 +1,401 @@
+package turnc
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+	"gortc.io/turnc/internal/testutil"
+)
+
+// allocateAuthenticated returns allocation that is authenticated with
+// "user:realm:secret" long-term credentials and "nonce" nonce.
+func allocateAuthenticated(t *testing.T, o Options) (*Client, *testSTUN, *Allocation) {
+	t.Helper()
+	o.RefreshDisabled = true
+	if o.Credentials == nil {
+		o.Username = "user"
+		o.Password = "secret"
+	}
+	c, stunClient := newTestClient(t, o)
+	integrity := stun.NewLongTermIntegrity("user", "realm", "secret")
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		var nonce stun.Nonce
+		if nonce.GetFrom(m) != nil {
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse),
+					stun.NewRealm("realm"), stun.NewNonce("nonce"),
+					stun.CodeUnauthorized, stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
+				&turn.RelayedAddress{
+					Port: 1113,
+					IP:   net.IPv4(127, 0, 0, 2),
+				},
+				integrity, stun.Fingerprint,
+			),
+		})
+		return nil
+	}
+	a, allocErr := c.Allocate()
+	if allocErr != nil {
+		t.Fatal(allocErr)
+	}
+	return c, stunClient, a
+}
+
+func TestAllocation_do(t *testing.T) {
+	t.Run("StaleNonce", func(t *testing.T) {
+		core, logs := observer.New(zapcore.DebugLevel)
+		_, stunClient, a := allocateAuthenticated(t, Options{Log: zap.New(core)})
+		integrity := stun.NewLongTermIntegrity("user", "realm", "secret")
+		serverNonce := stun.NewNonce("nonce-2")
+		var requests []stun.MessageType
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			requests = append(requests, m.Type)
+			if err := integrity.Check(m); err != nil {
+				t.Errorf("integrity check failed: %v", err)
+			}
+			var nonce stun.Nonce
+			if err := nonce.GetFrom(m); err != nil {
+				return err
+			}
+			if !bytes.Equal(nonce, serverNonce) {
+				f(stun.Event{
+					Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+						stun.CodeStaleNonce, serverNonce, stun.Fingerprint,
+					),
+				})
+				return nil
+			}
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+					integrity, stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		p, err := a.Create(net.IPv4(127, 0, 0, 3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := p.CreateUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 1001})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = conn.Bind(); err != nil {
+			t.Fatal(err)
+		}
+		expected := []stun.MessageType{
+			stun.NewType(stun.MethodCreatePermission, stun.ClassRequest),
+			stun.NewType(stun.MethodCreatePermission, stun.ClassRequest),
+			// Updated nonce is used without retry.
+			stun.NewType(stun.MethodChannelBind, stun.ClassRequest),
+		}
+		if len(requests) != len(expected) {
+			t.Fatalf("unexpected requests: %v", requests)
+		}
+		for i := range expected {
+			if requests[i] != expected[i] {
+				t.Errorf("[%d] unexpected request: %s", i, requests[i])
+			}
+		}
+		testutil.EnsureNoErrors(t, logs)
+	})
+	t.Run("Unauthorized", func(t *testing.T) {
+		var realms []string
+		_, stunClient, a := allocateAuthenticated(t, Options{
+			Credentials: CredentialProviderFunc(func(realm string) (Credentials, error) {
+				realms = append(realms, realm)
+				if realm == "realm-2" {
+					return Credentials{Username: "user-2", Password: "secret-2"}, nil
+				}
+				return Credentials{Username: "user", Password: "secret"}, nil
+			}),
+		})
+		integrity := stun.NewLongTermIntegrity("user-2", "realm-2", "secret-2")
+		var requests int
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			requests++
+			var username stun.Username
+			if err := username.GetFrom(m); err != nil {
+				return err
+			}
+			if username.String() != "user-2" {
+				// Credentials are rotated.
+				f(stun.Event{
+					Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+						stun.CodeUnauthorized, stun.NewRealm("realm-2"), stun.NewNonce("nonce-2"),
+						stun.Fingerprint,
+					),
+				})
+				return nil
+			}
+			if err := integrity.Check(m); err != nil {
+				t.Errorf("integrity check failed: %v", err)
+			}
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+					integrity, stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		if _, err := a.Create(net.IPv4(127, 0, 0, 3)); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.refresh(); err != nil {
+			t.Fatal(err)
+		}
+		if requests != 3 {
+			t.Errorf("unexpected requests count: %d", requests)
+		}
+		if len(realms) != 2 || realms[0] != "realm" || realms[1] != "realm-2" {
+			t.Errorf("unexpected credentials requests: %v", realms)
+		}
+	})
+	t.Run("RetryOnce", func(t *testing.T) {
+		_, stunClient, a := allocateAuthenticated(t, Options{})
+		var requests int
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			requests++
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+					stun.CodeStaleNonce, stun.NewNonce("nonce-2"), stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		if _, err := a.Create(net.IPv4(127, 0, 0, 3)); err == nil {
+			t.Error("should error")
+		}
+		if requests != 2 {
+			t.Errorf("unexpected requests count: %d", requests)
+		}
+	})
+	// rotating returns provider of credentials that expire after ttl, with
+	// "user" username on first call and "user-2" on next ones.
+	rotating := func(ttl time.Duration) CredentialProvider {
+		var calls int
+		return CredentialProviderFunc(func(realm string) (Credentials, error) {
+			calls++
+			if calls == 1 {
+				return Credentials{
+					Username: "user", Password: "secret",
+					Expires: time.Now().Add(ttl),
+				}, nil
+			}
+			return Credentials{
+				Username: "user-2", Password: "secret-2",
+				Expires: time.Now().Add(time.Hour),
+			}, nil
+		})
+	}
+	passwords := map[string]string{"user": "secret", "user-2": "secret-2"}
+	// serve responds to authenticated requests with success response,
+	// recording usernames of requests.
+	serve := func(t *testing.T, usernames *[]string) func(m *stun.Message, f func(e stun.Event)) error {
+		return func(m *stun.Message, f func(e stun.Event)) error {
+			var username stun.Username
+			if username.GetFrom(m) != nil {
+				*usernames = append(*usernames, "")
+				f(stun.Event{
+					Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+						stun.NewRealm("realm"), stun.NewNonce("nonce"),
+						stun.CodeUnauthorized, stun.Fingerprint,
+					),
+				})
+				return nil
+			}
+			*usernames = append(*usernames, username.String())
+			integrity := stun.NewLongTermIntegrity(username.String(), "realm", passwords[username.String()])
+			if err := integrity.Check(m); err != nil {
+				t.Errorf("integrity check failed: %v", err)
+			}
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+					&turn.RelayedAddress{
+						Port: 2000,
+						IP:   net.IPv4(127, 0, 0, 2),
+					},
+					integrity, stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+	}
+	t.Run("Expiring", func(t *testing.T) {
+		_, stunClient, a := allocateAuthenticated(t, Options{
+			Credentials: rotating(credentialsRenewBefore / 2),
+		})
+		// Username can't be changed during allocation, so initial
+		// credentials are used until expiration.
+		var usernames []string
+		stunClient.do = serve(t, &usernames)
+		if err := a.refresh(); err != nil {
+			t.Fatal(err)
+		}
+		if len(usernames) != 1 || usernames[0] != "user" {
+			t.Errorf("unexpected usernames: %v", usernames)
+		}
+	})
+	t.Run("Expired", func(t *testing.T) {
+		_, stunClient, a := allocateAuthenticated(t, Options{
+			Credentials: rotating(-time.Second),
+		})
+		var usernames []string
+		stunClient.do = serve(t, &usernames)
+		if err := a.refresh(); !errors.Is(err, ErrUsernameChanged) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if len(usernames) != 0 {
+			t.Errorf("unexpected usernames: %v", usernames)
+		}
+	})
+	t.Run("Unauthorized", func(t *testing.T) {
+		_, stunClient, a := allocateAuthenticated(t, Options{
+			Credentials: rotating(0),
+		})
+		// Rejected credentials are not retried with the same username.
+		var requests int
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			requests++
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+					stun.NewRealm("realm"), stun.NewNonce("nonce-2"),
+					stun.CodeUnauthorized, stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		if err := a.refresh(); !errors.Is(err, ErrUsernameChanged) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if requests != 1 {
+			t.Errorf("unexpected requests count: %d", requests)
+		}
+	})
+	t.Run("Reallocate", func(t *testing.T) {
+		_, stunClient, a := allocateAuthenticated(t, Options{
+			Credentials: rotating(credentialsRenewBefore / 2),
+			Recover:     true,
+		})
+		var usernames []string
+		stunClient.do = serve(t, &usernames)
+		if err := a.refresh(); err != nil {
+			t.Fatal(err)
+		}
+		// Allocation is deleted with current credentials and created
+		// again with new ones.
+		expected := []string{"user", "", "user-2"}
+		if len(usernames) != len(expected) {
+			t.Fatalf("unexpected usernames: %v", usernames)
+		}
+		for i := range expected {
+			if usernames[i] != expected[i] {
+				t.Errorf("[%d] unexpected username: %q", i, usernames[i])
+			}
+		}
+		if r := a.Relayed(); r.Port != 2000 {
+			t.Errorf("unexpected relayed address: %s", r)
+		}
+		usernames = usernames[:0]
+		if err := a.refresh(); err != nil {
+			t.Fatal(err)
+		}
+		if len(usernames) != 1 || usernames[0] != "user-2" {
+			t.Errorf("unexpected usernames: %v", usernames)
+		}
+	})
+}
+
+func TestAllocation_doIntegrity(t *testing.T) {
+	integrity := stun.NewLongTermIntegrity("user", "realm", "secret")
+	for _, tc := range []struct {
+		name     string
+		response func(m *stun.Message) *stun.Message
+	}{
+		{
+			name: "NoIntegrity",
+			response: func(m *stun.Message) *stun.Message {
+				return stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+					stun.Fingerprint,
+				)
+			},
+		},
+		{
+			name: "WrongIntegrity",
+			response: func(m *stun.Message) *stun.Message {
+				return stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+					stun.NewLongTermIntegrity("user", "realm", "guess"), stun.Fingerprint,
+				)
+			},
+		},
+		{
+			name: "WrongFingerprint",
+			response: func(m *stun.Message) *stun.Message {
+				res := stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+					integrity, stun.Fingerprint,
+				)
+				res.Raw[len(res.Raw)-1] ^= 1
+				return res
+			},
+		},
+		{
+			name: "UnprotectedError",
+			response: func(m *stun.Message) *stun.Message {
+				return stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+					stun.CodeForbidden, stun.Fingerprint,
+				)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, stunClient, a := allocateAuthenticated(t, Options{})
+			stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+				f(stun.Event{Message: tc.response(m)})
+				return nil
+			}
+			_, err := a.Create(net.IPv4(127, 0, 0, 3))
+			var integrityErr *IntegrityError
+			if !errors.As(err, &integrityErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if integrityErr.Method != stun.MethodCreatePermission {
+				t.Errorf("unexpected method: %s", integrityErr.Method)
+			}
+			if failures := c.Stats().IntegrityFailures; failures != 1 {
+				t.Errorf("unexpected failures count: %d", failures)
+			}
+		})
+	}
+	t.Run("ProtectedError", func(t *testing.T) {
+		c, stunClient, a := allocateAuthenticated(t, Options{})
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+					stun.CodeForbidden, integrity, stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		if _, err := a.Create(net.IPv4(127, 0, 0, 3)); !errors.Is(err, ErrForbidden) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if failures := c.Stats().IntegrityFailures; failures != 0 {
+			t.Errorf("unexpected failures count: %d", failures)
+		}
+	})
+}
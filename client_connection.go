@@ -2,9 +2,9 @@ package turnc
 
 import (
 	"context"
-	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -16,22 +16,30 @@ import (
 // Connection represents a UDP connectivity between local transport address
 // and remote transport address.
 type Connection struct {
-	log          *zap.Logger
-	mux          sync.RWMutex
-	number       turn.ChannelNumber
-	peerAddr     turn.PeerAddress
-	peerL, peerR net.Conn
-	client       *Client
-	perm         *Permission
-	ctx          context.Context
-	cancel       func()
-	wg           sync.WaitGroup
-	refreshRate  time.Duration
+	log         *zap.Logger
+	mux         sync.RWMutex
+	number      turn.ChannelNumber
+	peerAddr    turn.PeerAddress
+	packets     *packetQueue
+	client      *Client
+	perm        *Permission
+	task        *refreshTask // protected with mux
+	refreshRate time.Duration
 }
 
 // Read data from peer.
 func (c *Connection) Read(b []byte) (n int, err error) {
-	return c.peerR.Read(b)
+	n, _, err = c.packets.read(b)
+	return n, err
+}
+
+// handlePacket passes data from peer to Read, dropping it if there are
+// too many pending packets.
+func (c *Connection) handlePacket(data []byte) {
+	if !c.packets.push(data, turn.Addr(c.peerAddr)) {
+		atomic.AddUint64(&c.client.stats.droppedData, 1)
+		c.log.Debug("dropped packet", zap.Stringer("addr", turn.Addr(c.peerAddr)))
+	}
 }
 
 // Bound returns true if channel number is bound for current permission.
@@ -48,23 +56,11 @@ func (c *Connection) Binding() turn.ChannelNumber {
 	return c.number
 }
 
-func (c *Connection) startLoop(f func()) {
-	if c.refreshRate == 0 {
-		return
-	}
-	c.wg.Add(1)
-	go func() {
-		ticker := time.NewTicker(c.refreshRate)
-		defer c.wg.Done()
-		for {
-			select {
-			case <-ticker.C:
-				f()
-			case <-c.ctx.Done():
-				return
-			}
-		}
-	}()
+// refresh refreshes channel binding, recovering allocation if it is lost.
+func (c *Connection) refresh() error {
+	a := c.client.alloc
+	gen := a.generation()
+	return a.recoverLost(gen, c.refreshBind())
 }
 
 // refreshBind performs rebinding of a channel.
@@ -74,48 +70,34 @@ func (c *Connection) refreshBind() error {
 	if c.number == 0 {
 		return ErrNotBound
 	}
-	if err := c.bind(c.number); err != nil {
+	if err := c.bind(context.Background(), c.number); err != nil {
 		return err
 	}
 	c.log.Debug("binding refreshed")
 	return nil
 }
 
-func (c *Connection) bind(n turn.ChannelNumber) error {
+func (c *Connection) bind(ctx context.Context, n turn.ChannelNumber) error {
 	// Starting transaction.
 	a := c.client.alloc
 	res := stun.New()
-	req := stun.New()
-	req.TransactionID = stun.NewTransactionID()
-	req.Type = stun.NewType(stun.MethodChannelBind, stun.ClassRequest)
-	req.WriteHeader()
-	setters := make([]stun.Setter, 0, 10)
-	setters = append(setters, &c.peerAddr, n)
-	if len(a.integrity) > 0 {
-		// Applying auth.
-		setters = append(setters,
-			a.nonce, a.client.username, a.client.realm, a.integrity,
-		)
-	}
-	setters = append(setters, stun.Fingerprint)
-	for _, s := range setters {
-		if setErr := s.AddTo(req); setErr != nil {
-			return setErr
-		}
-	}
-	if doErr := c.client.do(req, res); doErr != nil {
+	if doErr := a.do(ctx, stun.MethodChannelBind, []stun.Setter{&c.peerAddr, n}, res); doErr != nil {
 		return doErr
 	}
-	if res.Type != stun.NewType(stun.MethodChannelBind, stun.ClassSuccessResponse) {
-		return fmt.Errorf("unexpected response type %s", res.Type)
-	}
-	// Success.
-	return nil
+	return checkResponse(stun.MethodChannelBind, res)
 }
 
 // Bind performs binding transaction, allocating channel binding for
 // the connection.
 func (c *Connection) Bind() error {
+	return c.BindContext(context.Background())
+}
+
+// BindContext is like Bind, but aborts binding transaction when ctx is
+// done.
+//
+// See ContextSTUNClient for transactions that are done after ctx.
+func (c *Connection) BindContext(ctx context.Context) error {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 	if c.number != 0 {
@@ -124,15 +106,24 @@ func (c *Connection) Bind() error {
 	a := c.client.alloc
 	a.minBound++
 	n := a.minBound
-	if err := c.bind(n); err != nil {
+	if err := c.bind(ctx, n); err != nil {
 		return err
 	}
 	c.number = n
-	c.startLoop(func() {
-		if err := c.refreshBind(); err != nil {
-			c.log.Error("failed to refresh bind", zap.Error(err))
+	c.client.mux.Lock()
+	a.channels[n] = c
+	c.client.mux.Unlock()
+	if c.refreshRate != 0 {
+		c.task = &refreshTask{
+			log:  c.log,
+			name: "bind",
+			interval: func() time.Duration {
+				return c.client.refreshInterval(channelLifetime)
+			},
+			refresh: c.refresh,
 		}
-	})
+		c.client.scheduler.add(c.task)
+	}
 	return nil
 }
 
@@ -148,22 +139,23 @@ func (c *Connection) Write(b []byte) (n int, err error) {
 	return c.client.sendData(b, &c.peerAddr)
 }
 
-// Close stops all refreshing loops for permission and removes it from
-// allocation.
+// Close stops refreshing of channel binding and removes connection from
+// permission.
 func (c *Connection) Close() error {
-	cErr := c.peerR.Close()
-	c.mux.Lock()
-	cancel := c.cancel
-	c.mux.Unlock()
-	cancel()
-	c.wg.Wait()
+	c.packets.close()
+	c.mux.RLock()
+	task := c.task
+	c.mux.RUnlock()
+	if task != nil {
+		c.client.scheduler.remove(task)
+	}
 	c.perm.removeConn(c)
-	return cErr
+	return nil
 }
 
 // LocalAddr is relayed address from TURN server.
 func (c *Connection) LocalAddr() net.Addr {
-	return turn.Addr(c.client.alloc.relayed)
+	return turn.Addr(c.client.alloc.Relayed())
 }
 
 // RemoteAddr is peer address.
@@ -171,14 +163,15 @@ func (c *Connection) RemoteAddr() net.Addr {
 	return turn.Addr(c.peerAddr)
 }
 
-// SetDeadline implements net.Conn.
+// SetDeadline implements net.Conn. Only read deadline is supported.
 func (c *Connection) SetDeadline(t time.Time) error {
-	return c.peerR.SetDeadline(t)
+	return c.SetReadDeadline(t)
 }
 
 // SetReadDeadline implements net.Conn.
 func (c *Connection) SetReadDeadline(t time.Time) error {
-	return c.peerR.SetReadDeadline(t)
+	c.packets.setReadDeadline(t)
+	return nil
 }
 
 // SetWriteDeadline implements net.Conn.
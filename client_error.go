@@ -0,0 +1,113 @@
+package turnc
+
+import (
+	"fmt"
+
+	"gortc.io/stun"
+)
+
+// Error is error response from TURN server to request. Use errors.As to
+// get details of response, or errors.Is to match one of sentinel errors
+// like ErrForbidden by code.
+type Error struct {
+	Method stun.Method
+	Code   stun.ErrorCode
+	Reason string
+	// Optional attributes of response.
+	Realm   stun.Realm
+	Nonce   stun.Nonce
+	Unknown stun.UnknownAttributes // UNKNOWN-ATTRIBUTES for 420 error
+}
+
+func (e *Error) Error() string {
+	if e.Method == 0 {
+		return fmt.Sprintf("error response: %d %s", e.Code, e.Reason)
+	}
+	return fmt.Sprintf("%s error response: %d %s", e.Method, e.Code, e.Reason)
+}
+
+// Is reports whether target is *Error with the same code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Sentinel errors for common error codes, matched by errors.Is, RFC 5766
+// Section 15.
+var (
+	// ErrForbidden means that request is valid, but can't be performed
+	// due to administrative or similar restrictions, e.g. peer address is
+	// not allowed.
+	ErrForbidden = &Error{Code: stun.CodeForbidden, Reason: "Forbidden"}
+	// ErrAllocationMismatch means that allocation does not exist on
+	// server, e.g. it is expired, or already exists for Allocate.
+	ErrAllocationMismatch = &Error{Code: stun.CodeAllocMismatch, Reason: "Allocation Mismatch"}
+	// ErrWrongCredentials means that credentials differ from ones used to
+	// create the allocation.
+	ErrWrongCredentials = &Error{Code: stun.CodeWrongCredentials, Reason: "Wrong Credentials"}
+	// ErrUnsupportedTransport means that requested transport protocol is
+	// not supported by server.
+	ErrUnsupportedTransport = &Error{Code: stun.CodeUnsupportedTransProto, Reason: "Unsupported Transport Protocol"}
+	// ErrAllocationQuotaReached means that no more allocations can be
+	// created for the user.
+	ErrAllocationQuotaReached = &Error{Code: stun.CodeAllocQuotaReached, Reason: "Allocation Quota Reached"}
+	// ErrInsufficientCapacity means that server is out of resources,
+	// e.g. relayed transport addresses or bandwidth.
+	ErrInsufficientCapacity = &Error{Code: stun.CodeInsufficientCapacity, Reason: "Insufficient Capacity"}
+)
+
+// IntegrityError is returned when response to authenticated request
+// fails MESSAGE-INTEGRITY or FINGERPRINT check, e.g. if it is spoofed by
+// off-path attacker. Failures are counted in Stats.IntegrityFailures.
+type IntegrityError struct {
+	Method stun.Method
+	Err    error // underlying check error
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("%s response verification failed: %v", e.Method, e.Err)
+}
+
+// Unwrap returns underlying check error, like stun.ErrIntegrityMismatch.
+func (e *IntegrityError) Unwrap() error { return e.Err }
+
+// newError returns *Error from error response.
+func newError(res *stun.Message) *Error {
+	e := &Error{
+		Method: res.Type.Method,
+	}
+	var code stun.ErrorCodeAttribute
+	if err := code.GetFrom(res); err == nil {
+		e.Code = code.Code
+		e.Reason = string(code.Reason)
+	}
+	// Attributes are optional, so ignoring errors.
+	var (
+		realm   stun.Realm
+		nonce   stun.Nonce
+		unknown stun.UnknownAttributes
+	)
+	if realm.GetFrom(res) == nil {
+		e.Realm = append(stun.Realm(nil), realm...)
+	}
+	if nonce.GetFrom(res) == nil {
+		e.Nonce = append(stun.Nonce(nil), nonce...)
+	}
+	if unknown.GetFrom(res) == nil {
+		e.Unknown = unknown
+	}
+	return e
+}
+
+// checkResponse returns nil if res is success response to request with
+// method, *Error for error response, or error otherwise.
+func checkResponse(method stun.Method, res *stun.Message) error {
+	switch res.Type {
+	case stun.NewType(method, stun.ClassSuccessResponse):
+		return nil
+	case stun.NewType(method, stun.ClassErrorResponse):
+		return newError(res)
+	default:
+		return fmt.Errorf("unexpected response type %s", res.Type)
+	}
+}
@@ -0,0 +1,51 @@
+package turnc
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"gortc.io/stun"
+)
+
+func TestError(t *testing.T) {
+	res := stun.MustBuild(stun.TransactionID,
+		stun.NewType(stun.MethodRefresh, stun.ClassErrorResponse),
+		stun.CodeAllocQuotaReached,
+		stun.NewRealm("realm"), stun.NewNonce("nonce"),
+		stun.Fingerprint,
+	)
+	err := fmt.Errorf("refresh: %w", checkResponse(stun.MethodRefresh, res))
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.Method != stun.MethodRefresh || e.Code != stun.CodeAllocQuotaReached {
+		t.Errorf("unexpected method or code: %s", e)
+	}
+	if e.Realm.String() != "realm" || e.Nonce.String() != "nonce" {
+		t.Errorf("unexpected attributes: %q, %q", e.Realm, e.Nonce)
+	}
+	if !errors.Is(err, ErrAllocationQuotaReached) {
+		t.Error("should match sentinel")
+	}
+	for _, sentinel := range []error{
+		ErrForbidden, ErrAllocationMismatch, ErrWrongCredentials,
+		ErrUnsupportedTransport, ErrInsufficientCapacity,
+	} {
+		if errors.Is(err, sentinel) {
+			t.Errorf("should not match %s", sentinel)
+		}
+	}
+	t.Run("Success", func(t *testing.T) {
+		res := stun.MustBuild(stun.TransactionID,
+			stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse),
+		)
+		if err := checkResponse(stun.MethodRefresh, res); err != nil {
+			t.Error(err)
+		}
+		if err := checkResponse(stun.MethodChannelBind, res); err == nil {
+			t.Error("should error on method mismatch")
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package turnc
+
+import (
+	"math/rand"
+	"time"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+)
+
+const (
+	// permissionLifetime is lifetime of permission, RFC 5766 Section 8.
+	permissionLifetime = time.Minute * 5
+	// channelLifetime is lifetime of channel binding, RFC 5766 Section 11.
+	channelLifetime = time.Minute * 10
+)
+
+// refreshInterval returns duration before next refresh of object with
+// provided lifetime.
+//
+// If refresh rate is set explicitly, it is used as is. Otherwise refresh
+// is scheduled at random point between half and three quarters of
+// lifetime, so refreshes of different clients are spread in time and
+// there is time for retransmissions before expiry.
+func (c *Client) refreshInterval(lifetime time.Duration) time.Duration {
+	if c.fixedRate {
+		return c.refreshRate
+	}
+	if lifetime <= 0 {
+		lifetime = turn.DefaultLifetime
+	}
+	half := lifetime / 2
+	return half + time.Duration(rand.Int63n(int64(half/2)+1))
+}
+
+// lifetimeFrom returns LIFETIME from message or fallback if there is no
+// such attribute.
+func lifetimeFrom(m *stun.Message, fallback time.Duration) (time.Duration, error) {
+	var lifetime turn.Lifetime
+	if err := lifetime.GetFrom(m); err != nil {
+		if err == stun.ErrAttributeNotFound {
+			return fallback, nil
+		}
+		return 0, err
+	}
+	return lifetime.Duration, nil
+}
+
+// setLifetime updates allocation expiration time with lifetime granted
+// by server.
+func (a *Allocation) setLifetime(lifetime time.Duration) {
+	a.lifetimeMux.Lock()
+	a.lifetime = lifetime
+	a.expires = time.Now().Add(lifetime)
+	a.lifetimeMux.Unlock()
+}
+
+// Lifetime returns last lifetime granted by server.
+func (a *Allocation) Lifetime() time.Duration {
+	a.lifetimeMux.RLock()
+	defer a.lifetimeMux.RUnlock()
+	return a.lifetime
+}
+
+// ExpiresAt returns time when allocation expires if not refreshed.
+func (a *Allocation) ExpiresAt() time.Time {
+	a.lifetimeMux.RLock()
+	defer a.lifetimeMux.RUnlock()
+	return a.expires
+}
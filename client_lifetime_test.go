@@ -0,0 +1,90 @@
+package turnc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+
+	"gortc.io/turnc/internal/testutil"
+)
+
+func TestClient_refreshInterval(t *testing.T) {
+	t.Run("Fixed", func(t *testing.T) {
+		c := &Client{refreshRate: time.Second, fixedRate: true}
+		if d := c.refreshInterval(channelLifetime); d != time.Second {
+			t.Errorf("unexpected interval: %s", d)
+		}
+	})
+	t.Run("Lifetime", func(t *testing.T) {
+		c := &Client{refreshRate: defaultRefreshRate}
+		for _, lifetime := range []time.Duration{
+			time.Second, permissionLifetime, channelLifetime,
+		} {
+			for i := 0; i < 100; i++ {
+				d := c.refreshInterval(lifetime)
+				if d < lifetime/2 || d > lifetime*3/4 {
+					t.Fatalf("interval %s is out of range for %s", d, lifetime)
+				}
+			}
+		}
+		if d := c.refreshInterval(0); d < turn.DefaultLifetime/2 {
+			t.Errorf("unexpected interval for zero lifetime: %s", d)
+		}
+	})
+}
+
+func TestAllocation_Lifetime(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	connL, connR := net.Pipe()
+	defer mustClose(t, connL)
+	stunClient := &testSTUN{}
+	c, createErr := New(Options{
+		Log:             zap.New(core),
+		Conn:            connR, // should not be used
+		STUN:            stunClient,
+		RefreshDisabled: true,
+	})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	granted := time.Minute * 3
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+				&turn.RelayedAddress{
+					Port: 1113,
+					IP:   net.IPv4(127, 0, 0, 2),
+				},
+				turn.Lifetime{Duration: granted},
+				stun.Fingerprint,
+			),
+		})
+		return nil
+	}
+	start := time.Now()
+	a, allocErr := c.Allocate()
+	if allocErr != nil {
+		t.Fatal(allocErr)
+	}
+	if a.Lifetime() != granted {
+		t.Errorf("unexpected lifetime: %s", a.Lifetime())
+	}
+	if expires := a.ExpiresAt(); expires.Before(start.Add(granted)) || expires.After(time.Now().Add(granted)) {
+		t.Errorf("unexpected expiration: %s", expires)
+	}
+	granted = time.Minute
+	if err := a.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if a.Lifetime() != granted {
+		t.Errorf("unexpected lifetime after refresh: %s", a.Lifetime())
+	}
+	testutil.EnsureNoErrors(t, logs)
+}
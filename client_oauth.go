@@ -0,0 +1,152 @@
+package turnc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"gortc.io/stun"
+)
+
+// Attributes of third-party authorization, RFC 7635 Section 6.
+const (
+	attrAccessToken             stun.AttrType = 0x001B // ACCESS-TOKEN
+	attrThirdPartyAuthorization stun.AttrType = 0x802E // THIRD-PARTY-AUTHORIZATION
+)
+
+// AccessToken is OAuth access token for third-party authorization,
+// RFC 7635, issued to client by authorization server.
+type AccessToken struct {
+	// KeyID is key identifier ("kid"), sent as USERNAME.
+	KeyID string
+	// Token is encrypted token, opaque for client and sent as
+	// ACCESS-TOKEN, see NewAccessToken.
+	Token []byte
+	// SessionKey is session key ("mac_key") that is used as key for
+	// MESSAGE-INTEGRITY.
+	SessionKey []byte
+	// Expires is time when token is no longer valid, zero value means
+	// that it does not expire. Expiring tokens are requested from
+	// provider again before expiration.
+	Expires time.Time
+}
+
+// TokenProvider provides OAuth access tokens for authorization server.
+//
+// Provider is called with value of THIRD-PARTY-AUTHORIZATION attribute
+// (or empty string) on each 401 (Unauthorized) response, including
+// responses to Refresh, CreatePermission and ChannelBind requests, and
+// before token expiration.
+type TokenProvider interface {
+	AccessToken(server string) (AccessToken, error)
+}
+
+// TokenProviderFunc is adapter to use function as TokenProvider.
+type TokenProviderFunc func(server string) (AccessToken, error)
+
+// AccessToken calls f(server).
+func (f TokenProviderFunc) AccessToken(server string) (AccessToken, error) {
+	return f(server)
+}
+
+// accessToken is ACCESS-TOKEN attribute.
+type accessToken []byte
+
+// AddTo adds ACCESS-TOKEN to message.
+func (t accessToken) AddTo(m *stun.Message) error {
+	m.Add(attrAccessToken, t)
+	return nil
+}
+
+// tokenAuth requests access token from token provider, returning
+// credentials with provided realm and nonce that can be empty.
+func (c *Client) tokenAuth(server string, realm stun.Realm, nonce stun.Nonce) (longTermAuth, error) {
+	token, err := c.tokens.AccessToken(server)
+	if err != nil {
+		return longTermAuth{}, err
+	}
+	if len(token.SessionKey) == 0 {
+		return longTermAuth{}, errors.New("no session key in access token")
+	}
+	return longTermAuth{
+		username:   stun.NewUsername(token.KeyID),
+		realm:      append(stun.Realm(nil), realm...),
+		nonce:      append(stun.Nonce(nil), nonce...),
+		token:      append(accessToken(nil), token.Token...),
+		authServer: server,
+		integrity:  append(stun.MessageIntegrity(nil), token.SessionKey...),
+		expires:    token.Expires,
+	}, nil
+}
+
+// Access token encryption key lengths for AEAD_AES_128_GCM and
+// AEAD_AES_256_GCM, RFC 7635 Section 6.2.
+const (
+	tokenKeySize128 = 16
+	tokenKeySize256 = 32
+)
+
+// Sizes of access token fields, RFC 7635 Section 6.2.
+const (
+	tokenLengthSize    = 2 // length of session key or nonce
+	tokenTimestampSize = 8
+	tokenLifetimeSize  = 4
+)
+
+// errTokenKey means that key for access token encryption has invalid
+// length.
+var errTokenKey = errors.New("invalid access token key length")
+
+// NewAccessToken returns encrypted token for ACCESS-TOKEN attribute in
+// format of RFC 7635 Section 6.2, that contains session key and
+// validity period from issued for lifetime.
+//
+// The token is encrypted with AES-GCM by key that is shared by
+// authorization server and TURN server (16 or 32 bytes for
+// AEAD_AES_128_GCM or AEAD_AES_256_GCM), and is authenticated with
+// serverName of TURN server as associated data. Normally, tokens are
+// issued by authorization server, so this is useful for tests and
+// servers.
+func NewAccessToken(key []byte, serverName string, sessionKey []byte, issued time.Time, lifetime time.Duration) ([]byte, error) {
+	if len(key) != tokenKeySize128 && len(key) != tokenKeySize256 {
+		return nil, errTokenKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// Encrypted block is key length, session key, timestamp and lifetime.
+	var (
+		timestampStart = tokenLengthSize + len(sessionKey)
+		lifetimeStart  = timestampStart + tokenTimestampSize
+		plain          = make([]byte, lifetimeStart+tokenLifetimeSize)
+	)
+	binary.BigEndian.PutUint16(plain, uint16(len(sessionKey)))
+	copy(plain[tokenLengthSize:], sessionKey)
+	binary.BigEndian.PutUint64(plain[timestampStart:], tokenTimestamp(issued))
+	binary.BigEndian.PutUint32(plain[lifetimeStart:], uint32(lifetime/time.Second))
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	token := make([]byte, tokenLengthSize, tokenLengthSize+len(nonce)+len(plain)+aead.Overhead())
+	binary.BigEndian.PutUint16(token, uint16(len(nonce)))
+	token = append(token, nonce...)
+	return aead.Seal(token, nonce, plain, []byte(serverName)), nil
+}
+
+// tokenTimestamp returns 64-bit timestamp of access token, which is 48
+// bits of seconds since unix epoch and 16 bits of fraction in 1/64000
+// of second.
+func tokenTimestamp(t time.Time) uint64 {
+	fraction := uint64(t.Nanosecond()) * 64000 / uint64(time.Second)
+	return uint64(t.Unix())<<16 | fraction
+}
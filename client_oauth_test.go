@@ -0,0 +1,173 @@
+package turnc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+)
+
+// openAccessToken decrypts token like TURN server, returning session key,
+// timestamp and lifetime.
+func openAccessToken(t *testing.T, key []byte, serverName string, token []byte) ([]byte, uint64, time.Duration) {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonceLength := int(binary.BigEndian.Uint16(token))
+	nonce := token[2 : 2+nonceLength]
+	plain, err := aead.Open(nil, nonce, token[2+nonceLength:], []byte(serverName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyLength := int(binary.BigEndian.Uint16(plain))
+	sessionKey := plain[2 : 2+keyLength]
+	timestamp := binary.BigEndian.Uint64(plain[2+keyLength:])
+	lifetime := time.Duration(binary.BigEndian.Uint32(plain[2+keyLength+8:])) * time.Second
+	return sessionKey, timestamp, lifetime
+}
+
+func TestNewAccessToken(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 16)
+	sessionKey := []byte("session-key")
+	issued := time.Unix(1700000000, int64(time.Second/2))
+	token, err := NewAccessToken(key, "turn.example.org", sessionKey, issued, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotKey, timestamp, lifetime := openAccessToken(t, key, "turn.example.org", token)
+	if !bytes.Equal(gotKey, sessionKey) {
+		t.Errorf("unexpected session key: %q", gotKey)
+	}
+	if timestamp != 1700000000<<16|32000 {
+		t.Errorf("unexpected timestamp: %d", timestamp)
+	}
+	if lifetime != time.Hour {
+		t.Errorf("unexpected lifetime: %s", lifetime)
+	}
+	t.Run("BadKey", func(t *testing.T) {
+		if _, err := NewAccessToken([]byte("short"), "", sessionKey, issued, time.Hour); err != errTokenKey {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestClient_Tokens(t *testing.T) {
+	key := bytes.Repeat([]byte{2}, 32)
+	var (
+		servers []string
+		issued  int
+	)
+	provider := TokenProviderFunc(func(server string) (AccessToken, error) {
+		servers = append(servers, server)
+		issued++
+		sessionKey := bytes.Repeat([]byte{byte(issued)}, 20)
+		token, err := NewAccessToken(key, "turn.example.org", sessionKey, time.Now(), time.Hour)
+		if err != nil {
+			return AccessToken{}, err
+		}
+		expires := time.Now().Add(time.Hour)
+		if issued == 1 {
+			// First token is about to expire.
+			expires = time.Now().Add(credentialsRenewBefore / 2)
+		}
+		return AccessToken{
+			KeyID:      "kid",
+			Token:      token,
+			SessionKey: sessionKey,
+			Expires:    expires,
+		}, nil
+	})
+	connL, connR := net.Pipe()
+	defer mustClose(t, connL)
+	stunClient := &testSTUN{}
+	c, createErr := New(Options{
+		Conn:            connR,
+		STUN:            stunClient,
+		Tokens:          provider,
+		RefreshDisabled: true,
+	})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	var methods []stun.Method
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		token, err := m.Get(attrAccessToken)
+		if err != nil {
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+					stun.CodeUnauthorized, stun.NewNonce("nonce"),
+					stun.RawAttribute{Type: attrThirdPartyAuthorization, Value: []byte("auth.example.org")},
+					stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		methods = append(methods, m.Type.Method)
+		var username stun.Username
+		if err = username.GetFrom(m); err != nil || username.String() != "kid" {
+			t.Errorf("unexpected username: %s (%v)", username, err)
+		}
+		sessionKey, _, _ := openAccessToken(t, key, "turn.example.org", token)
+		if err = stun.MessageIntegrity(sessionKey).Check(m); err != nil {
+			t.Errorf("integrity check failed: %v", err)
+		}
+		attrs := []stun.Setter{stun.NewType(m.Type.Method, stun.ClassSuccessResponse)}
+		if m.Type.Method == stun.MethodAllocate {
+			attrs = append(attrs, &turn.RelayedAddress{
+				Port: 1113,
+				IP:   net.IPv4(127, 0, 0, 2),
+			})
+		}
+		attrs = append(attrs, stun.MessageIntegrity(sessionKey), stun.Fingerprint)
+		f(stun.Event{
+			Message: stun.MustBuild(append([]stun.Setter{m}, attrs...)...),
+		})
+		return nil
+	}
+	a, err := c.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := a.Create(net.IPv4(127, 0, 0, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := p.CreateUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 1001})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.Bind(); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []stun.Method{
+		stun.MethodAllocate, stun.MethodCreatePermission,
+		stun.MethodChannelBind, stun.MethodRefresh,
+	}
+	if len(methods) != len(expected) {
+		t.Fatalf("unexpected requests: %v", methods)
+	}
+	for i := range expected {
+		if methods[i] != expected[i] {
+			t.Errorf("[%d] unexpected request: %s", i, methods[i])
+		}
+	}
+	// Expiring token is renewed before CreatePermission.
+	if len(servers) != 2 || servers[0] != "auth.example.org" || servers[1] != "auth.example.org" {
+		t.Errorf("unexpected token requests: %v", servers)
+	}
+}
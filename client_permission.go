@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -12,16 +13,17 @@ import (
 	"gortc.io/turn"
 )
 
-// Permission implements net.PacketConn.
+// Permission implements net.PacketConn, sending and receiving data to any
+// port on the peer IP address.
 type Permission struct {
 	log         *zap.Logger
 	mux         sync.RWMutex
 	ip          net.IP
 	client      *Client
-	ctx         context.Context
-	cancel      func()
-	wg          sync.WaitGroup
+	task        *refreshTask
 	refreshRate time.Duration
+	refreshed   time.Time    // protected with mux
+	packets     *packetQueue // protected with mux, see queue
 	conn        []*Connection
 }
 
@@ -30,53 +32,157 @@ var (
 	ErrAlreadyBound = errors.New("channel already bound")
 	// ErrNotBound means that selected permission already has no channel number.
 	ErrNotBound = errors.New("channel is not bound")
+	// ErrPeerMismatch means that peer IP address differs from permission IP.
+	ErrPeerMismatch = errors.New("peer is not covered by permission")
 )
 
 func (p *Permission) refresh() error {
-	return p.client.alloc.allocate(turn.PeerAddress{IP: p.ip})
+	if err := p.client.alloc.allocate(context.Background(), turn.PeerAddress{IP: p.ip}); err != nil {
+		return err
+	}
+	p.setRefreshed()
+	return nil
+}
+
+func (p *Permission) setRefreshed() {
+	p.mux.Lock()
+	p.refreshed = time.Now()
+	p.mux.Unlock()
+}
+
+// refreshedAt returns time of last successful permission refresh.
+func (p *Permission) refreshedAt() time.Time {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	return p.refreshed
 }
 
-func (p *Permission) startLoop(f func()) {
+// connection returns Connection to peer or nil.
+func (p *Permission) connection(peer turn.PeerAddress) *Connection {
+	p.client.mux.RLock()
+	defer p.client.mux.RUnlock()
+	for _, c := range p.conn {
+		if turn.Addr(c.peerAddr).Equal(turn.Addr(peer)) {
+			return c
+		}
+	}
+	return nil
+}
+
+// startRefresh schedules permission refresh, which can be coalesced with
+// refreshes of other permissions.
+func (p *Permission) startRefresh() {
 	if p.refreshRate == 0 {
 		return
 	}
-	p.wg.Add(1)
-	go func() {
-		ticker := time.NewTicker(p.refreshRate)
-		defer p.wg.Done()
-		for {
-			select {
-			case <-ticker.C:
-				f()
-			case <-p.ctx.Done():
-				return
-			}
-		}
-	}()
+	p.task = &refreshTask{
+		log:  p.log,
+		name: "permission",
+		interval: func() time.Duration {
+			return p.client.refreshInterval(permissionLifetime)
+		},
+		perm: p,
+	}
+	p.client.scheduler.add(p.task)
 }
 
-func (p *Permission) startRefreshLoop() {
-	p.startLoop(func() {
-		if err := p.refresh(); err != nil {
-			p.log.Error("failed to refresh permission", zap.Error(err))
-		}
-		p.log.Debug("permission refreshed")
-	})
+// queue returns packet queue of permission, creating it on first use.
+//
+// Data from peers without Connection is passed to Allocation.ReadFrom until
+// permission is used as net.PacketConn.
+func (p *Permission) queue() *packetQueue {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.packets == nil {
+		p.packets = newPacketQueue()
+	}
+	return p.packets
+}
+
+// handlePacket passes data from peer to ReadFrom, returning false if
+// permission is not used as net.PacketConn.
+func (p *Permission) handlePacket(data []byte, addr turn.Addr) bool {
+	p.mux.RLock()
+	q := p.packets
+	p.mux.RUnlock()
+	if q == nil {
+		return false
+	}
+	if !q.push(data, addr) {
+		atomic.AddUint64(&p.client.stats.droppedData, 1)
+		p.log.Debug("dropped packet", zap.Stringer("addr", addr))
+	}
+	return true
 }
 
-// WriteTo writes packet b to addr.
+// ReadFrom implements net.PacketConn, reading data from any port of peer
+// that has no Connection.
+func (p *Permission) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	return p.queue().read(b)
+}
+
+// WriteTo writes packet b to addr. The addr IP should be equal to
+// permission IP.
+//
+// The ChannelData message is used if there is bound Connection to addr,
+// otherwise Send indication is used.
 func (p *Permission) WriteTo(b []byte, addr net.Addr) (n int, err error) {
-	return 0, ErrNotImplemented
+	peer, err := peerAddress(addr)
+	if err != nil {
+		return 0, err
+	}
+	if !peer.IP.Equal(p.ip) {
+		return 0, ErrPeerMismatch
+	}
+	// Replies should be read via ReadFrom.
+	p.queue()
+	if c := p.connection(peer); c != nil {
+		return c.Write(b)
+	}
+	return p.client.sendData(b, &peer)
+}
+
+// LocalAddr is relayed address from TURN server.
+func (p *Permission) LocalAddr() net.Addr {
+	return turn.Addr(p.client.alloc.Relayed())
+}
+
+// SetDeadline implements net.PacketConn. Only read deadline is supported.
+func (p *Permission) SetDeadline(t time.Time) error {
+	return p.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+func (p *Permission) SetReadDeadline(t time.Time) error {
+	p.queue().setReadDeadline(t)
+	return nil
 }
 
-// Close stops all refreshing loops for permission and removes it from
-// allocation.
+// SetWriteDeadline implements net.PacketConn. Writes are not blocking,
+// so write deadline is ignored.
+func (p *Permission) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Close stops refreshing of permission, closes its connections
+// and removes it from allocation.
 func (p *Permission) Close() error {
 	p.mux.Lock()
-	cancel := p.cancel
+	if p.packets != nil {
+		p.packets.close()
+	}
 	p.mux.Unlock()
-	cancel()
-	p.wg.Wait()
+	if p.task != nil {
+		p.client.scheduler.remove(p.task)
+	}
+	// Connection.Close removes connection from permission, so closing
+	// copy of connections list without holding the lock.
+	p.client.mux.RLock()
+	conns := append([]*Connection(nil), p.conn...)
+	p.client.mux.RUnlock()
+	for _, c := range conns {
+		closeLogged(p.log, "failed to close connection", c)
+	}
 	p.client.alloc.removePermission(p)
 	return nil
 }
@@ -85,22 +191,42 @@ func (p *Permission) Close() error {
 // but it will be (eventually).
 var ErrNotImplemented = errors.New("functionality not implemented")
 
-func (p *Permission) removeConn(connection *Connection) {}
-
-// CreateUDP creates new UDP Permission to peer with provided addr.
-func (p *Permission) CreateUDP(addr *net.UDPAddr) (*Connection, error) {
-	peer := turn.PeerAddress{
-		IP:   addr.IP,
-		Port: addr.Port,
+func (p *Permission) removeConn(connection *Connection) {
+	n := connection.Binding()
+	p.client.mux.Lock()
+	if a := p.client.alloc; a != nil && a.channels[n] == connection {
+		delete(a.channels, n)
+	}
+	newConns := make([]*Connection, 0, len(p.conn))
+	for _, c := range p.conn {
+		if c == connection {
+			continue
+		}
+		newConns = append(newConns, c)
 	}
+	p.conn = newConns
+	p.client.mux.Unlock()
+}
+
+func (p *Permission) newConnection(peer turn.PeerAddress) *Connection {
 	c := &Connection{
 		log:         p.log,
 		peerAddr:    peer,
 		client:      p.client,
+		perm:        p,
 		refreshRate: p.client.refreshRate,
+		packets:     newPacketQueue(),
+	}
+	return c
+}
+
+// CreateUDP creates new UDP Permission to peer with provided addr.
+func (p *Permission) CreateUDP(addr *net.UDPAddr) (*Connection, error) {
+	peer := turn.PeerAddress{
+		IP:   addr.IP,
+		Port: addr.Port,
 	}
-	c.ctx, c.cancel = context.WithCancel(context.Background())
-	c.peerL, c.peerR = net.Pipe()
+	c := p.newConnection(peer)
 	p.client.mux.Lock()
 	p.conn = append(p.conn, c)
 	p.client.mux.Unlock()
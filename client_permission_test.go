@@ -525,6 +525,7 @@ func TestPermission(t *testing.T) {
 								Port: 1113,
 								IP:   net.IPv4(127, 0, 0, 2),
 							},
+							integrity,
 							stun.Fingerprint,
 						),
 					})
@@ -612,3 +613,99 @@ func TestPermission(t *testing.T) {
 		})
 	})
 }
+
+func TestPermission_PacketConn(t *testing.T) {
+	var _ net.PacketConn = &Permission{}
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	connL, connR := net.Pipe()
+	defer mustClose(t, connL)
+	stunClient := &testSTUN{}
+	c, createErr := New(Options{
+		Log:             zap.New(core),
+		Conn:            connR, // should not be used
+		STUN:            stunClient,
+		RefreshDisabled: true,
+	})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+				&turn.RelayedAddress{
+					Port: 1113,
+					IP:   net.IPv4(127, 0, 0, 2),
+				},
+				stun.Fingerprint,
+			),
+		})
+		return nil
+	}
+	a, allocErr := c.Allocate()
+	if allocErr != nil {
+		t.Fatal(allocErr)
+	}
+	p, permErr := a.Create(net.IPv4(127, 0, 0, 3))
+	if permErr != nil {
+		t.Fatal(permErr)
+	}
+	if !p.LocalAddr().(turn.Addr).Equal(turn.Addr(a.relayed)) {
+		t.Errorf("unexpected local addr: %s", p.LocalAddr())
+	}
+	var sent []int
+	stunClient.indicate = func(m *stun.Message) error {
+		var peer turn.PeerAddress
+		if err := peer.GetFrom(m); err != nil {
+			t.Error(err)
+		}
+		sent = append(sent, peer.Port)
+		return nil
+	}
+	for _, port := range []int{1001, 1002} {
+		if _, err := p.WriteTo([]byte("hello"), &net.UDPAddr{IP: p.ip, Port: port}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sent) != 2 || sent[0] != 1001 || sent[1] != 1002 {
+		t.Errorf("unexpected sent: %v", sent)
+	}
+	if _, err := p.WriteTo([]byte("hello"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 4), Port: 1001}); err != ErrPeerMismatch {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, peer := range []turn.PeerAddress{
+		{IP: net.IPv4(127, 0, 0, 3), Port: 1002},
+		{IP: net.IPv4(127, 0, 0, 4), Port: 1002}, // no permission
+	} {
+		c.stunHandler(stun.Event{
+			Message: stun.MustBuild(stun.TransactionID, dataIndication,
+				turn.Data("world"), &peer,
+			),
+		})
+	}
+	buf := make([]byte, 1024)
+	n, addr, err := p.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "world" || addr.(turn.Addr).Port != 1002 {
+		t.Errorf("unexpected packet %q from %s", buf[:n], addr)
+	}
+	// Data from peer without permission is dropped.
+	if n := c.Stats().UnpermittedData; n != 1 {
+		t.Errorf("unexpected unpermitted count: %d", n)
+	}
+	if err = p.SetDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = p.ReadFrom(buf); err == nil {
+		t.Error("should timeout")
+	}
+	testutil.EnsureNoErrors(t, logs)
+	if err = p.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, _, err = p.ReadFrom(buf); err != ErrClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package turnc
+
+import (
+	"context"
+	"errors"
+
+	"go.uber.org/zap"
+
+	"gortc.io/turn"
+)
+
+// generation returns count of allocation recoveries.
+func (a *Allocation) generation() uint64 {
+	a.addrMux.RLock()
+	defer a.addrMux.RUnlock()
+	return a.gen
+}
+
+// recoverLost recovers allocation if recovery is enabled and err of
+// allocation, permission or channel binding refresh means that allocation
+// is lost, returning err otherwise. The gen is generation of allocation
+// before refresh, so loss that is detected by several refreshes is
+// recovered once.
+func (a *Allocation) recoverLost(gen uint64, err error) error {
+	if !a.client.recover || !errors.Is(err, ErrAllocationMismatch) {
+		return err
+	}
+	a.log.Warn("allocation lost", zap.Error(err))
+	return a.recover(gen)
+}
+
+// reallocate deletes allocation and allocates again, because new
+// credentials have different username, see ErrUsernameChanged.
+func (a *Allocation) reallocate(gen uint64) error {
+	a.log.Info("reallocating with new username")
+	err := a.refreshLifetime(0)
+	if err != nil && !errors.Is(err, ErrAllocationMismatch) && !errors.Is(err, ErrUsernameChanged) {
+		return err
+	}
+	// Allocation can't be deleted with expired credentials, so it is
+	// allocated again after expiration on server.
+	return a.recover(gen)
+}
+
+// recover allocates again after allocation loss, updating allocation with
+// new relayed addresses and credentials, installing permissions and
+// rebinding channels of existing connections.
+//
+// Only the failure of allocation itself is returned, so it is retried
+// by the allocation refresh.
+func (a *Allocation) recover(gen uint64) error {
+	a.recoverMux.Lock()
+	defer a.recoverMux.Unlock()
+	if a.generation() != gen {
+		a.log.Debug("allocation is already recovered")
+		return nil
+	}
+	o := a.opts
+	// Reserved port can't be allocated again.
+	o.ReservationToken = nil
+	n, err := a.client.allocateRedirect(context.Background(), o)
+	if err != nil {
+		return err
+	}
+	// Only state of new allocation is used.
+	n.cancel()
+	n.packets.close()
+	a.addrMux.Lock()
+	a.gen++
+	a.relayed = n.relayed
+	a.addrs = n.addrs
+	a.familyErr = n.familyErr
+	a.reflexive = n.reflexive
+	a.addrMux.Unlock()
+	a.authMux.Lock()
+	a.auth = n.auth
+	a.authMux.Unlock()
+	a.setLifetime(n.Lifetime())
+	a.log.Info("allocation recovered", zap.Stringer("relayed", n.relayed))
+
+	a.client.mux.RLock()
+	perms := append([]*Permission(nil), a.perms...)
+	var conns []*Connection
+	for _, p := range perms {
+		conns = append(conns, p.conn...)
+	}
+	a.client.mux.RUnlock()
+	if len(perms) > 0 {
+		peers := make([]turn.PeerAddress, 0, len(perms))
+		for _, p := range perms {
+			peers = append(peers, turn.PeerAddress{IP: p.ip})
+		}
+		// Failed permissions and bindings are installed again by their
+		// own refreshes, so allocation is recovered anyway.
+		if err := a.allocate(context.Background(), peers...); err != nil {
+			a.log.Warn("failed to recover permissions", zap.Error(err))
+		} else {
+			for _, p := range perms {
+				p.setRefreshed()
+			}
+		}
+	}
+	for _, c := range conns {
+		if !c.Bound() {
+			continue
+		}
+		if err := c.refreshBind(); err != nil {
+			a.log.Warn("failed to recover binding", zap.Error(err))
+		}
+	}
+	if a.client.onRecover != nil {
+		// Calling without holding locks and waiting for refresh, so
+		// callback can close allocation or client.
+		go a.client.onRecover(n.relayed)
+	}
+	return nil
+}
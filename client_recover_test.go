@@ -0,0 +1,228 @@
+package turnc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+	"gortc.io/turnc/internal/testutil"
+)
+
+func TestAllocation_recover(t *testing.T) {
+	allocate := func(t *testing.T, o Options) (*testSTUN, *Allocation, *Connection) {
+		_, stunClient, a := newTestAllocation(t, o)
+		p, err := a.Create(net.IPv4(127, 0, 0, 3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := p.CreateUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 1001})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = conn.Bind(); err != nil {
+			t.Fatal(err)
+		}
+		return stunClient, a, conn
+	}
+	mismatch := func(m *stun.Message, f func(e stun.Event)) {
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+				stun.CodeAllocMismatch, stun.Fingerprint,
+			),
+		})
+	}
+	t.Run("Recover", func(t *testing.T) {
+		core, logs := observer.New(zapcore.DebugLevel)
+		recovered := make(chan turn.RelayedAddress, 1)
+		stunClient, a, conn := allocate(t, Options{
+			Log:     zap.New(core),
+			Recover: true,
+			OnRecover: func(relayed turn.RelayedAddress) {
+				recovered <- relayed
+			},
+		})
+		var (
+			methods []stun.Method
+			binding = conn.Binding()
+		)
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			methods = append(methods, m.Type.Method)
+			switch m.Type.Method {
+			case stun.MethodRefresh:
+				mismatch(m, f)
+				return nil
+			case stun.MethodChannelBind:
+				var n turn.ChannelNumber
+				if err := n.GetFrom(m); err != nil {
+					t.Error(err)
+				}
+				if n != binding {
+					t.Errorf("unexpected channel number: %d", n)
+				}
+			}
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+					&turn.RelayedAddress{
+						Port: 2000,
+						IP:   net.IPv4(127, 0, 0, 2),
+					},
+					stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		if err := a.refresh(); err != nil {
+			t.Fatal(err)
+		}
+		expected := []stun.Method{
+			stun.MethodRefresh, stun.MethodAllocate,
+			stun.MethodCreatePermission, stun.MethodChannelBind,
+		}
+		if len(methods) != len(expected) {
+			t.Fatalf("unexpected requests: %v", methods)
+		}
+		for i := range expected {
+			if methods[i] != expected[i] {
+				t.Errorf("[%d] unexpected request: %s", i, methods[i])
+			}
+		}
+		if r := a.Relayed(); r.Port != 2000 {
+			t.Errorf("unexpected relayed address: %s", r)
+		}
+		select {
+		case r := <-recovered:
+			if r.Port != 2000 {
+				t.Errorf("unexpected recovered address: %s", r)
+			}
+		case <-time.After(time.Second * 5):
+			t.Error("OnRecover not called")
+		}
+		if a.client.alloc != a {
+			t.Error("allocation should not be replaced")
+		}
+		testutil.EnsureNoErrors(t, logs)
+	})
+	t.Run("Binding", func(t *testing.T) {
+		core, logs := observer.New(zapcore.DebugLevel)
+		stunClient, a, conn := allocate(t, Options{
+			Log:     zap.New(core),
+			Recover: true,
+		})
+		var methods []stun.Method
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			methods = append(methods, m.Type.Method)
+			if len(methods) == 1 {
+				mismatch(m, f)
+				return nil
+			}
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+					&turn.RelayedAddress{
+						Port: 2000,
+						IP:   net.IPv4(127, 0, 0, 2),
+					},
+					stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		gen := a.generation()
+		if err := conn.refresh(); err != nil {
+			t.Fatal(err)
+		}
+		expected := []stun.Method{
+			stun.MethodChannelBind, stun.MethodAllocate,
+			stun.MethodCreatePermission, stun.MethodChannelBind,
+		}
+		if len(methods) != len(expected) {
+			t.Fatalf("unexpected requests: %v", methods)
+		}
+		for i := range expected {
+			if methods[i] != expected[i] {
+				t.Errorf("[%d] unexpected request: %s", i, methods[i])
+			}
+		}
+		if r := a.Relayed(); r.Port != 2000 {
+			t.Errorf("unexpected relayed address: %s", r)
+		}
+		// Loss that is detected before recovery is not recovered again.
+		if err := a.recover(gen); err != nil {
+			t.Error(err)
+		}
+		if len(methods) != len(expected) {
+			t.Errorf("unexpected requests: %v", methods)
+		}
+		testutil.EnsureNoErrors(t, logs)
+	})
+	t.Run("CloseOnRecover", func(t *testing.T) {
+		var (
+			c      *Client
+			closed = make(chan error, 1)
+		)
+		c, stunClient := newTestClient(t, Options{
+			Recover:     true,
+			RefreshRate: time.Millisecond * 50,
+			OnRecover: func(relayed turn.RelayedAddress) {
+				closed <- c.Close()
+			},
+		})
+		var (
+			mux  sync.Mutex
+			lost bool
+		)
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			mux.Lock()
+			first := m.Type.Method == stun.MethodRefresh && !lost
+			if first {
+				lost = true
+			}
+			mux.Unlock()
+			if first {
+				mismatch(m, f)
+				return nil
+			}
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+					&turn.RelayedAddress{
+						Port: 2000,
+						IP:   net.IPv4(127, 0, 0, 2),
+					},
+					stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		if _, err := c.Allocate(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Error("client not closed")
+		}
+	})
+	t.Run("Disabled", func(t *testing.T) {
+		stunClient, a, _ := allocate(t, Options{})
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			if m.Type.Method != stun.MethodRefresh {
+				t.Errorf("unexpected request: %s", m.Type)
+			}
+			mismatch(m, f)
+			return nil
+		}
+		if err := a.refresh(); !errors.Is(err, ErrAllocationMismatch) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package turnc
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gortc.io/stun"
+)
+
+// attrAlternateDomain is ALTERNATE-DOMAIN attribute type, RFC 8489
+// Section 14.16.
+const attrAlternateDomain stun.AttrType = 0x8003
+
+// maxRedirects is maximum count of 300 (Try Alternate) responses that are
+// followed during single Allocate.
+const maxRedirects = 3
+
+var (
+	// ErrRedirectLoop means that Allocate was redirected to already tried
+	// server or redirected too many times.
+	ErrRedirectLoop = errors.New("redirect loop")
+	// ErrRedirectNotSupported means that Allocate was redirected, but the
+	// client is unable to dial alternate server, see
+	// Options.DialAlternate.
+	ErrRedirectNotSupported = errors.New("redirect is not supported for connection")
+)
+
+// tryAlternate is returned by allocate on 300 (Try Alternate) response.
+type tryAlternate struct {
+	addr   string
+	domain string
+}
+
+func (t *tryAlternate) Error() string {
+	return "try alternate server " + t.addr
+}
+
+// newTryAlternate returns tryAlternate from ALTERNATE-SERVER and
+// ALTERNATE-DOMAIN attributes of response.
+func newTryAlternate(res *stun.Message) (*tryAlternate, error) {
+	var server stun.AlternateServer
+	if err := server.GetFrom(res); err != nil {
+		return nil, err
+	}
+	t := &tryAlternate{
+		addr: net.JoinHostPort(server.IP.String(), strconv.Itoa(server.Port)),
+	}
+	if domain, err := res.Get(attrAlternateDomain); err == nil {
+		t.domain = string(domain)
+	}
+	return t, nil
+}
+
+// defaultDialAlternate returns dialer of alternate servers in the same
+// network as conn, or nil if network can't be redialed.
+func defaultDialAlternate(conn net.Conn) func(addr, domain string) (net.Conn, error) {
+	var network string
+	switch conn.(type) {
+	case *net.UDPConn:
+		network = "udp"
+	case *net.TCPConn:
+		network = "tcp"
+	default:
+		return nil
+	}
+	return func(addr, domain string) (net.Conn, error) {
+		return net.Dial(network, addr)
+	}
+}
+
+// manualConn is connection provided by user with Options.ConnManualClose.
+// Close only interrupts pending reads, so client can stop reading from
+// connection on redirect, leaving it open.
+type manualConn struct {
+	net.Conn
+}
+
+func (c *manualConn) Close() error {
+	return c.SetReadDeadline(time.Now())
+}
+
+// redirect replaces connection to server with connection to alternate
+// server. Connection to previous server is closed, unless it is provided
+// by user with Options.ConnManualClose.
+func (c *Client) redirect(t *tryAlternate) error {
+	c.connMux.RLock()
+	customSTUN := c.customSTUN
+	c.connMux.RUnlock()
+	if c.dialAlternate == nil || customSTUN {
+		return ErrRedirectNotSupported
+	}
+	c.log.Info("redirected",
+		zap.String("addr", t.addr), zap.String("domain", t.domain),
+	)
+	conn, err := c.dialAlternate(t.addr, t.domain)
+	if err != nil {
+		return err
+	}
+	c.connMux.Lock()
+	prevConn, prevSTUN, prevDone, manual := c.con, c.stun, c.done, c.manualConn
+	if err = c.setConn(conn, nil); err != nil {
+		c.connMux.Unlock()
+		closeLogged(c.log, "failed to close connection", conn)
+		return err
+	}
+	// Connection to alternate server is created by client, so it is
+	// always closed.
+	c.conClose = true
+	c.manualConn = nil
+	c.connMux.Unlock()
+
+	c.stopConn(prevConn, prevSTUN, prevDone, manual)
+	return nil
+}
@@ -0,0 +1,194 @@
+package turnc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+	"gortc.io/turnc/internal/testutil"
+)
+
+// serveOnce reads single request from conn and responds to it with
+// provided class and attributes.
+func serveOnce(t *testing.T, conn net.Conn, class stun.MessageClass, setters ...stun.Setter) {
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	m := &stun.Message{Raw: buf[:n]}
+	if err = m.Decode(); err != nil {
+		t.Error(err)
+		return
+	}
+	res := stun.MustBuild(append([]stun.Setter{
+		m, stun.NewType(m.Type.Method, class),
+	}, setters...)...)
+	if _, err = conn.Write(res.Raw); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClient_AllocateRedirect(t *testing.T) {
+	timeout := time.Second * 5
+	alternate := &stun.AlternateServer{
+		IP:   net.IPv4(127, 0, 0, 2),
+		Port: 3478,
+	}
+	tryAlternate := []stun.Setter{
+		stun.CodeTryAlternate, alternate,
+		&stun.RawAttribute{
+			Type:  attrAlternateDomain,
+			Value: []byte("example.com"),
+		},
+		stun.Fingerprint,
+	}
+	t.Run("Redirect", func(t *testing.T) {
+		core, logs := observer.New(zapcore.DebugLevel)
+		serverL, serverR := net.Pipe()
+		alternateL, alternateR := net.Pipe()
+		_ = serverL.SetDeadline(time.Now().Add(timeout))
+		_ = alternateL.SetDeadline(time.Now().Add(timeout))
+		c, err := New(Options{
+			Log:          zap.New(core),
+			Conn:         serverR,
+			RTO:          timeout,
+			NoRetransmit: true,
+			DialAlternate: func(addr, domain string) (net.Conn, error) {
+				if addr != "127.0.0.2:3478" {
+					t.Errorf("unexpected addr: %s", addr)
+				}
+				if domain != "example.com" {
+					t.Errorf("unexpected domain: %s", domain)
+				}
+				return alternateR, nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveOnce(t, serverL, stun.ClassErrorResponse, tryAlternate...)
+		go serveOnce(t, alternateL, stun.ClassSuccessResponse,
+			&turn.RelayedAddress{
+				IP:   net.IPv4(127, 0, 0, 3),
+				Port: 1001,
+			},
+			stun.Fingerprint,
+		)
+		a, err := c.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := a.Relayed(); r.Port != 1001 || !r.IP.Equal(net.IPv4(127, 0, 0, 3)) {
+			t.Errorf("unexpected relayed addr: %s", r)
+		}
+		if _, err = serverL.Read(make([]byte, 10)); err == nil {
+			t.Error("connection to previous server should be closed")
+		}
+		testutil.EnsureNoErrors(t, logs)
+		// Allocation is deleted on alternate server.
+		go serveOnce(t, alternateL, stun.ClassSuccessResponse, stun.Fingerprint)
+		mustClose(t, c)
+	})
+	t.Run("ManualClose", func(t *testing.T) {
+		serverL, serverR := net.Pipe()
+		alternateL, alternateR := net.Pipe()
+		_ = serverL.SetDeadline(time.Now().Add(timeout))
+		_ = alternateL.SetDeadline(time.Now().Add(timeout))
+		defer mustClose(t, serverL)
+		c, err := New(Options{
+			Conn:            serverR,
+			ConnManualClose: true,
+			RTO:             timeout,
+			NoRetransmit:    true,
+			DialAlternate: func(addr, domain string) (net.Conn, error) {
+				return alternateR, nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveOnce(t, serverL, stun.ClassErrorResponse, tryAlternate...)
+		go serveOnce(t, alternateL, stun.ClassSuccessResponse,
+			&turn.RelayedAddress{
+				IP:   net.IPv4(127, 0, 0, 3),
+				Port: 1001,
+			},
+			stun.Fingerprint,
+		)
+		if _, err = c.Allocate(); err != nil {
+			t.Fatal(err)
+		}
+		// Connection to previous server is left open and not read by client.
+		go func() {
+			if _, writeErr := serverL.Write([]byte{1, 2, 3}); writeErr != nil {
+				t.Error(writeErr)
+			}
+		}()
+		_ = serverR.SetReadDeadline(time.Now().Add(timeout))
+		buf := make([]byte, 10)
+		if n, readErr := serverR.Read(buf); readErr != nil || n != 3 {
+			t.Errorf("unexpected read: %d %v", n, readErr)
+		}
+		// Connection to alternate server is closed.
+		go serveOnce(t, alternateL, stun.ClassSuccessResponse, stun.Fingerprint)
+		mustClose(t, c)
+		if _, err = alternateL.Read(buf); err == nil {
+			t.Error("connection to alternate server should be closed")
+		}
+	})
+	t.Run("Loop", func(t *testing.T) {
+		serverL, serverR := net.Pipe()
+		_ = serverL.SetDeadline(time.Now().Add(timeout))
+		var alternates []net.Conn
+		c, err := New(Options{
+			Conn:         serverR,
+			RTO:          timeout,
+			NoRetransmit: true,
+			DialAlternate: func(addr, domain string) (net.Conn, error) {
+				alternateL, alternateR := net.Pipe()
+				_ = alternateL.SetDeadline(time.Now().Add(timeout))
+				alternates = append(alternates, alternateL)
+				// Alternate server redirects to itself.
+				go serveOnce(t, alternateL, stun.ClassErrorResponse, tryAlternate...)
+				return alternateR, nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mustClose(t, c)
+		go serveOnce(t, serverL, stun.ClassErrorResponse, tryAlternate...)
+		if _, err = c.Allocate(); err != ErrRedirectLoop {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if len(alternates) != 1 {
+			t.Errorf("unexpected dials count: %d", len(alternates))
+		}
+	})
+	t.Run("NotSupported", func(t *testing.T) {
+		serverL, serverR := net.Pipe()
+		_ = serverL.SetDeadline(time.Now().Add(timeout))
+		defer mustClose(t, serverL)
+		c, err := New(Options{
+			Conn:         serverR,
+			RTO:          timeout,
+			NoRetransmit: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mustClose(t, c)
+		go serveOnce(t, serverL, stun.ClassErrorResponse, tryAlternate...)
+		if _, err = c.Allocate(); err != ErrRedirectNotSupported {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package turnc
+
+import "sync/atomic"
+
+// Stats contains counters of client.
+type Stats struct {
+	// IntegrityFailures is count of responses to authenticated requests
+	// that failed MESSAGE-INTEGRITY or FINGERPRINT check.
+	IntegrityFailures uint64
+	// MalformedSTUN is count of dropped STUN messages that failed to
+	// decode, data indications without data or peer address, and
+	// connection attempts without connection id or peer address.
+	MalformedSTUN uint64
+	// MalformedChannelData is count of dropped ChannelData messages that
+	// failed to decode.
+	MalformedChannelData uint64
+	// UnpermittedData is count of dropped data indications from peers
+	// without installed permission and ChannelData messages with
+	// channel number that is not bound.
+	UnpermittedData uint64
+	// DroppedData is count of packets from peers that were dropped
+	// because too many packets were pending read.
+	DroppedData uint64
+}
+
+// stats contains counters for Stats that are updated atomically.
+type stats struct {
+	integrityFailures    uint64
+	malformedSTUN        uint64
+	malformedChannelData uint64
+	unpermittedData      uint64
+	droppedData          uint64
+}
+
+// Stats returns current counters of client.
+func (c *Client) Stats() Stats {
+	return Stats{
+		IntegrityFailures:    atomic.LoadUint64(&c.stats.integrityFailures),
+		MalformedSTUN:        atomic.LoadUint64(&c.stats.malformedSTUN),
+		MalformedChannelData: atomic.LoadUint64(&c.stats.malformedChannelData),
+		UnpermittedData:      atomic.LoadUint64(&c.stats.unpermittedData),
+		DroppedData:          atomic.LoadUint64(&c.stats.droppedData),
+	}
+}
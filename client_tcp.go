@@ -0,0 +1,320 @@
+package turnc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+)
+
+// ErrNotTCP means that allocation was not created with TCP transport,
+// so TCP relaying (RFC 6062) is not available.
+var ErrNotTCP = errors.New("allocation transport is not TCP")
+
+// connectionBindTimeout is the time in which ConnectionBind should be
+// completed after successful Connect, RFC 6062 Section 5.3.
+const connectionBindTimeout = time.Second * 30
+
+// connectionID represents CONNECTION-ID attribute, RFC 6062 Section 6.2.1.
+type connectionID uint32
+
+const connectionIDSize = 4 // 4 bytes, 32 bits
+
+// AddTo adds CONNECTION-ID to message.
+func (id connectionID) AddTo(m *stun.Message) error {
+	v := make([]byte, connectionIDSize)
+	binary.BigEndian.PutUint32(v, uint32(id))
+	m.Add(stun.AttrConnectionID, v)
+	return nil
+}
+
+// GetFrom decodes CONNECTION-ID from message.
+func (id *connectionID) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrConnectionID)
+	if err != nil {
+		return err
+	}
+	if err = stun.CheckSize(stun.AttrConnectionID, len(v), connectionIDSize); err != nil {
+		return err
+	}
+	*id = connectionID(binary.BigEndian.Uint32(v))
+	return nil
+}
+
+// connect performs Connect transaction to peer, returning connection id
+// for the ConnectionBind.
+func (a *Allocation) connect(peer turn.PeerAddress) (connectionID, error) {
+	res := stun.New()
+	if doErr := a.do(context.Background(), stun.MethodConnect, []stun.Setter{&peer}, res); doErr != nil {
+		return 0, doErr
+	}
+	if err := checkResponse(stun.MethodConnect, res); err != nil {
+		return 0, err
+	}
+	var id connectionID
+	if err := id.GetFrom(res); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// readMessage reads one STUN message from r.
+func readMessage(r io.Reader) (*stun.Message, error) {
+	header := make([]byte, stunHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !stun.IsMessage(header) {
+		return nil, ErrUnexpectedStreamData
+	}
+	length, _, err := frameLength(header)
+	if err != nil {
+		return nil, err
+	}
+	m := stun.New()
+	m.Raw = append(m.Raw[:0], header...)
+	m.Raw = append(m.Raw, make([]byte, length-stunHeaderSize)...)
+	if _, err = io.ReadFull(r, m.Raw[stunHeaderSize:]); err != nil {
+		return nil, err
+	}
+	if err = m.Decode(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// bindConnection opens new data connection to server and performs
+// ConnectionBind transaction on it with provided connection id.
+func (a *Allocation) bindConnection(id connectionID, peer turn.PeerAddress) (net.Conn, error) {
+	conn, err := a.client.dialData()
+	if err != nil {
+		return nil, err
+	}
+	c, err := a.doBindConnection(conn, id, peer)
+	if err != nil {
+		closeLogged(a.log, "failed to close data connection", conn)
+		return nil, err
+	}
+	return c, nil
+}
+
+func (a *Allocation) doBindConnection(conn net.Conn, id connectionID, peer turn.PeerAddress) (net.Conn, error) {
+	req := stun.New()
+	req.TransactionID = stun.NewTransactionID()
+	req.Type = stun.NewType(stun.MethodConnectionBind, stun.ClassRequest)
+	req.WriteHeader()
+	setters := make([]stun.Setter, 0, 10)
+	auth, err := a.currentAuth()
+	if err != nil {
+		return nil, err
+	}
+	setters = append(setters, id, auth, stun.Fingerprint)
+	for _, s := range setters {
+		if setErr := s.AddTo(req); setErr != nil {
+			return nil, setErr
+		}
+	}
+	if err := conn.SetDeadline(time.Now().Add(connectionBindTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(req.Raw); err != nil {
+		return nil, err
+	}
+	// Peer data can follow the response immediately, so buffered reader
+	// is kept for the connection.
+	r := bufio.NewReaderSize(conn, packetSize)
+	res, err := readMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	if res.TransactionID != req.TransactionID {
+		return nil, errors.New("unexpected transaction id")
+	}
+	if err := a.client.checkResponseIntegrity(auth, res); err != nil {
+		return nil, err
+	}
+	if err := checkResponse(stun.MethodConnectionBind, res); err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &tcpConnection{
+		Conn:     conn,
+		r:        r,
+		relayed:  a.Relayed(),
+		peerAddr: peer,
+	}, nil
+}
+
+// tcpConnection represents TCP connection to peer via TURN server,
+// RFC 6062. Data is relayed as-is over the data connection to server.
+type tcpConnection struct {
+	net.Conn
+	r        *bufio.Reader
+	relayed  turn.RelayedAddress
+	peerAddr turn.PeerAddress
+}
+
+// Read data from peer.
+func (c *tcpConnection) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// LocalAddr is relayed address from TURN server.
+func (c *tcpConnection) LocalAddr() net.Addr {
+	return turn.Addr(c.relayed)
+}
+
+// RemoteAddr is peer address.
+func (c *tcpConnection) RemoteAddr() net.Addr {
+	return turn.Addr(c.peerAddr)
+}
+
+// CreateTCP establishes new TCP connection to peer with provided addr via
+// TURN server, performing Connect and ConnectionBind transactions as
+// described in RFC 6062 Section 4.3.
+//
+// The allocation must be created with ProtoTCP transport.
+func (p *Permission) CreateTCP(addr *net.TCPAddr) (net.Conn, error) {
+	a := p.client.alloc
+	if a.transport != ProtoTCP {
+		return nil, ErrNotTCP
+	}
+	peer := turn.PeerAddress{
+		IP:   addr.IP,
+		Port: addr.Port,
+	}
+	id, err := a.connect(peer)
+	if err != nil {
+		return nil, err
+	}
+	return a.bindConnection(id, peer)
+}
+
+// ErrListenerClosed means that listener is closed.
+var ErrListenerClosed = errors.New("listener closed")
+
+// ErrAlreadyListening means that allocation already has TCP listener.
+var ErrAlreadyListening = errors.New("allocation is already listening")
+
+// listenBacklog is maximum count of pending connection attempts.
+const listenBacklog = 16
+
+var connectionAttemptIndication = stun.NewType(stun.MethodConnectionAttempt, stun.ClassIndication)
+
+// connectionAttempt is ConnectionAttempt indication from server,
+// RFC 6062 Section 4.4.
+type connectionAttempt struct {
+	id   connectionID
+	peer turn.PeerAddress
+}
+
+// tcpListener accepts incoming TCP connections from peers that connect
+// to relayed transport address, as described in RFC 6062 Section 4.4.
+type tcpListener struct {
+	log      *zap.Logger
+	alloc    *Allocation
+	attempts chan connectionAttempt
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Accept waits for ConnectionAttempt indication from server and performs
+// ConnectionBind, returning connection to peer.
+//
+// Attempts that failed to bind are logged and skipped.
+func (l *tcpListener) Accept() (net.Conn, error) {
+	for {
+		select {
+		case attempt := <-l.attempts:
+			conn, err := l.alloc.bindConnection(attempt.id, attempt.peer)
+			if err != nil {
+				l.log.Error("failed to bind connection", zap.Stringer("peer", attempt.peer), zap.Error(err))
+				continue
+			}
+			return conn, nil
+		case <-l.done:
+			return nil, ErrListenerClosed
+		}
+	}
+}
+
+// Close stops listening, any blocked Accept operations will be unblocked
+// and return ErrListenerClosed.
+func (l *tcpListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.alloc.client.mux.Lock()
+		if l.alloc.listener == l {
+			l.alloc.listener = nil
+		}
+		l.alloc.client.mux.Unlock()
+	})
+	return nil
+}
+
+// Addr is relayed address from TURN server.
+func (l *tcpListener) Addr() net.Addr {
+	return turn.Addr(l.alloc.Relayed())
+}
+
+// ListenTCP returns listener that accepts TCP connections from peers to
+// relayed transport address, RFC 6062 Section 4.4. Only peers with
+// installed permission can connect.
+//
+// The allocation must be created with ProtoTCP transport.
+func (a *Allocation) ListenTCP() (net.Listener, error) {
+	if a.transport != ProtoTCP {
+		return nil, ErrNotTCP
+	}
+	a.client.mux.Lock()
+	defer a.client.mux.Unlock()
+	if a.listener != nil {
+		return nil, ErrAlreadyListening
+	}
+	a.listener = &tcpListener{
+		log:      a.log,
+		alloc:    a,
+		attempts: make(chan connectionAttempt, listenBacklog),
+		done:     make(chan struct{}),
+	}
+	return a.listener, nil
+}
+
+func (c *Client) handleConnectionAttempt(m *stun.Message) {
+	var (
+		id   connectionID
+		addr turn.PeerAddress
+	)
+	if err := m.Parse(&id, &addr); err != nil {
+		atomic.AddUint64(&c.stats.malformedSTUN, 1)
+		c.log.Debug("failed to parse connection attempt", zap.Error(err))
+		return
+	}
+	c.mux.RLock()
+	var l *tcpListener
+	if c.alloc != nil {
+		l = c.alloc.listener
+	}
+	c.mux.RUnlock()
+	if l == nil {
+		c.log.Warn("no listener for connection attempt", zap.Stringer("peer", addr))
+		return
+	}
+	select {
+	case l.attempts <- connectionAttempt{id: id, peer: addr}:
+	default:
+		c.log.Warn("listener backlog is full, dropping connection attempt", zap.Stringer("peer", addr))
+	}
+}
@@ -0,0 +1,407 @@
+package turnc
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+	"gortc.io/turnc/internal/testutil"
+)
+
+func TestConnectionID(t *testing.T) {
+	m := stun.New()
+	id := connectionID(0x1234)
+	if err := id.AddTo(m); err != nil {
+		t.Fatal(err)
+	}
+	var got connectionID
+	if err := got.GetFrom(m); err != nil {
+		t.Fatal(err)
+	}
+	if got != id {
+		t.Errorf("%d (got) != %d (expected)", got, id)
+	}
+	t.Run("NotFound", func(t *testing.T) {
+		if err := got.GetFrom(stun.New()); err != stun.ErrAttributeNotFound {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("BadSize", func(t *testing.T) {
+		bad := stun.New()
+		bad.Add(stun.AttrConnectionID, []byte{1, 2, 3})
+		if err := got.GetFrom(bad); err == nil {
+			t.Error("should error")
+		}
+	})
+}
+
+// serveTCPRelay is minimal RFC 6062 TURN server, that handles control
+// connection and one data connection, sending greeting and echoing
+// back any data from the client.
+//
+// If attempt is set, ConnectionAttempt indication is sent after
+// CreatePermission request.
+func serveTCPRelay(t *testing.T, ln net.Listener, id connectionID, greeting []byte, attempt bool) {
+	t.Helper()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	go func() {
+		defer mustClose(t, conn)
+		control := newStreamConn(conn)
+		buf := make([]byte, 1500)
+		for {
+			n, readErr := control.Read(buf)
+			if readErr != nil {
+				return
+			}
+			m := &stun.Message{Raw: buf[:n]}
+			if decodeErr := m.Decode(); decodeErr != nil {
+				t.Error(decodeErr)
+				return
+			}
+			setters := []stun.Setter{
+				m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+				&turn.RelayedAddress{
+					IP:   net.IPv4(127, 0, 0, 1),
+					Port: 1001,
+				},
+			}
+			if m.Type.Method == stun.MethodAllocate {
+				var transport turn.RequestedTransport
+				if getErr := transport.GetFrom(m); getErr != nil {
+					t.Error(getErr)
+				}
+				if transport.Protocol != ProtoTCP {
+					t.Errorf("unexpected transport %s", transport)
+				}
+			}
+			if m.Type.Method == stun.MethodConnect {
+				setters = append(setters, id)
+			}
+			setters = append(setters, stun.Fingerprint)
+			if _, writeErr := control.Write(stun.MustBuild(setters...).Raw); writeErr != nil {
+				t.Error(writeErr)
+			}
+			if !attempt || m.Type.Method != stun.MethodCreatePermission {
+				continue
+			}
+			var peer turn.PeerAddress
+			if getErr := peer.GetFrom(m); getErr != nil {
+				t.Error(getErr)
+			}
+			peer.Port = 1003
+			indication := stun.MustBuild(stun.TransactionID, connectionAttemptIndication,
+				id, &peer, stun.Fingerprint,
+			)
+			if _, writeErr := control.Write(indication.Raw); writeErr != nil {
+				t.Error(writeErr)
+			}
+		}
+	}()
+	data, err := ln.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer mustClose(t, data)
+	m, err := readMessage(data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if m.Type != stun.NewType(stun.MethodConnectionBind, stun.ClassRequest) {
+		t.Errorf("unexpected type %s", m.Type)
+	}
+	var gotID connectionID
+	if err = gotID.GetFrom(m); err != nil {
+		t.Error(err)
+	}
+	if gotID != id {
+		t.Errorf("unexpected connection id %d", gotID)
+	}
+	res := stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse), stun.Fingerprint)
+	// Sending response and peer data in one write.
+	if _, err = data.Write(append(res.Raw, greeting...)); err != nil {
+		t.Error(err)
+	}
+	if _, err = io.Copy(data, data); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPermission_CreateTCP(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mustClose(t, ln)
+	timeout := time.Second * 10
+	greeting := []byte("hello")
+	go serveTCPRelay(t, ln, 0x1234, greeting, false)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, createErr := New(Options{
+		Log:          zap.New(core),
+		Conn:         conn,
+		RTO:          timeout,
+		NoRetransmit: true,
+	})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	defer mustClose(t, c)
+	a, allocErr := c.AllocateWithOptions(AllocateOptions{
+		Transport: ProtoTCP,
+	})
+	if allocErr != nil {
+		t.Fatal(allocErr)
+	}
+	peer := &net.TCPAddr{
+		IP:   net.IPv4(127, 0, 0, 3),
+		Port: 1003,
+	}
+	p, permErr := a.Create(peer.IP)
+	if permErr != nil {
+		t.Fatal(permErr)
+	}
+	peerConn, err := p.CreateTCP(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mustClose(t, peerConn)
+	if !turn.Addr(a.Relayed()).Equal(peerConn.LocalAddr().(turn.Addr)) {
+		t.Errorf("unexpected local addr %s", peerConn.LocalAddr())
+	}
+	if peerConn.RemoteAddr().String() != (turn.Addr{IP: peer.IP, Port: peer.Port}).String() {
+		t.Errorf("unexpected remote addr %s", peerConn.RemoteAddr())
+	}
+	_ = peerConn.SetDeadline(time.Now().Add(timeout))
+	buf := make([]byte, len(greeting))
+	if _, err = io.ReadFull(peerConn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, greeting) {
+		t.Errorf("unexpected greeting %q", buf)
+	}
+	sent := []byte{1, 2, 3, 4, 5}
+	if _, err = peerConn.Write(sent); err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, len(sent))
+	if _, err = io.ReadFull(peerConn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, sent) {
+		t.Error("data mismatch")
+	}
+	testutil.EnsureNoErrors(t, logs)
+}
+
+func TestPermission_CreateTCPErrors(t *testing.T) {
+	connL, connR := net.Pipe()
+	defer mustClose(t, connL)
+	stunClient := &testSTUN{}
+	c, createErr := New(Options{
+		Conn: connR,
+		STUN: stunClient,
+	})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+				&turn.RelayedAddress{
+					Port: 1113,
+					IP:   net.IPv4(127, 0, 0, 2),
+				},
+				stun.Fingerprint,
+			),
+		})
+		return nil
+	}
+	peer := &net.TCPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: 1001,
+	}
+	t.Run("NotTCP", func(t *testing.T) {
+		a, allocErr := c.Allocate()
+		if allocErr != nil {
+			t.Fatal(allocErr)
+		}
+		p, permErr := a.Create(peer.IP)
+		if permErr != nil {
+			t.Fatal(permErr)
+		}
+		if _, err := p.CreateTCP(peer); err != ErrNotTCP {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	a, allocErr := c.AllocateWithOptions(AllocateOptions{Transport: ProtoTCP})
+	if allocErr != nil {
+		t.Fatal(allocErr)
+	}
+	p, permErr := a.Create(peer.IP)
+	if permErr != nil {
+		t.Fatal(permErr)
+	}
+	t.Run("NoConnectionID", func(t *testing.T) {
+		if _, err := p.CreateTCP(peer); err != stun.ErrAttributeNotFound {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("ErrorResponse", func(t *testing.T) {
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+					stun.CodeConnTimeoutOrFailure,
+					stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		if _, err := p.CreateTCP(peer); err == nil {
+			t.Error("should error")
+		}
+	})
+}
+
+func TestAllocation_ListenTCP(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mustClose(t, ln)
+	timeout := time.Second * 10
+	greeting := []byte("hello")
+	go serveTCPRelay(t, ln, 0x4321, greeting, true)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, createErr := New(Options{
+		Log:          zap.New(core),
+		Conn:         conn,
+		RTO:          timeout,
+		NoRetransmit: true,
+	})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	defer mustClose(t, c)
+	a, allocErr := c.AllocateWithOptions(AllocateOptions{
+		Transport: ProtoTCP,
+	})
+	if allocErr != nil {
+		t.Fatal(allocErr)
+	}
+	l, listenErr := a.ListenTCP()
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	if _, err = a.ListenTCP(); err != ErrAlreadyListening {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !turn.Addr(a.Relayed()).Equal(l.Addr().(turn.Addr)) {
+		t.Errorf("unexpected addr %s", l.Addr())
+	}
+	peerIP := net.IPv4(127, 0, 0, 3)
+	if _, err = a.Create(peerIP); err != nil {
+		t.Fatal(err)
+	}
+	peerConn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mustClose(t, peerConn)
+	if peerConn.RemoteAddr().String() != (turn.Addr{IP: peerIP, Port: 1003}).String() {
+		t.Errorf("unexpected remote addr %s", peerConn.RemoteAddr())
+	}
+	_ = peerConn.SetDeadline(time.Now().Add(timeout))
+	buf := make([]byte, len(greeting))
+	if _, err = io.ReadFull(peerConn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, greeting) {
+		t.Errorf("unexpected greeting %q", buf)
+	}
+	testutil.EnsureNoErrors(t, logs)
+	mustClose(t, l)
+	if _, err = l.Accept(); err != ErrListenerClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if l, err = a.ListenTCP(); err != nil {
+		t.Errorf("should be able to listen again: %v", err)
+	} else {
+		mustClose(t, l)
+	}
+}
+
+func TestClient_handleConnectionAttempt(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	connL, connR := net.Pipe()
+	defer mustClose(t, connL)
+	c, createErr := New(Options{
+		Log:  zap.New(core),
+		Conn: connR,
+	})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	peer := &turn.PeerAddress{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: 1001,
+	}
+	t.Run("ParseErr", func(t *testing.T) {
+		c.stunHandler(stun.Event{
+			Message: stun.MustBuild(stun.TransactionID, connectionAttemptIndication),
+		})
+		if n := c.Stats().MalformedSTUN; n != 1 {
+			t.Errorf("unexpected malformed count: %d", n)
+		}
+		if logs.Len() > 0 {
+			t.Error("no logs expected")
+		}
+	})
+	t.Run("NoListener", func(t *testing.T) {
+		c.stunHandler(stun.Event{
+			Message: stun.MustBuild(stun.TransactionID, connectionAttemptIndication,
+				connectionID(1), peer,
+			),
+		})
+		if logs.FilterMessage("no listener for connection attempt").Len() != 1 {
+			t.Error("expected warning not found")
+		}
+	})
+	t.Run("BacklogFull", func(t *testing.T) {
+		c.alloc = &Allocation{client: c, log: c.log, transport: ProtoTCP}
+		if _, err := c.alloc.ListenTCP(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i <= listenBacklog; i++ {
+			c.stunHandler(stun.Event{
+				Message: stun.MustBuild(stun.TransactionID, connectionAttemptIndication,
+					connectionID(i), peer,
+				),
+			})
+		}
+		if logs.FilterMessage("listener backlog is full, dropping connection attempt").Len() != 1 {
+			t.Error("expected warning not found")
+		}
+	})
+}
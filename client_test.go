@@ -2,11 +2,11 @@ package turnc
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -438,6 +438,47 @@ func mustClose(t *testing.T, closer io.Closer) {
 	}
 }
 
+// newTestClient returns client with testSTUN on connection that should
+// not be used.
+func newTestClient(t *testing.T, o Options) (*Client, *testSTUN) {
+	t.Helper()
+	connL, connR := net.Pipe()
+	t.Cleanup(func() { mustClose(t, connL) })
+	stunClient := &testSTUN{}
+	o.Conn = connR // should not be used
+	o.STUN = stunClient
+	c, createErr := New(o)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	return c, stunClient
+}
+
+// newTestAllocation returns client with allocation on server that
+// accepts any request. Refreshes are disabled.
+func newTestAllocation(t *testing.T, o Options) (*Client, *testSTUN, *Allocation) {
+	t.Helper()
+	o.RefreshDisabled = true
+	c, stunClient := newTestClient(t, o)
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+				&turn.RelayedAddress{
+					Port: 1113,
+					IP:   net.IPv4(127, 0, 0, 2),
+				},
+				stun.Fingerprint,
+			),
+		})
+		return nil
+	}
+	a, allocErr := c.Allocate()
+	if allocErr != nil {
+		t.Fatal(allocErr)
+	}
+	return c, stunClient, a
+}
+
 func TestClient_STUNHandler(t *testing.T) {
 	core, logs := observer.New(zapcore.DebugLevel)
 	connL, connR := testPipe(t, "server", "client")
@@ -469,115 +510,129 @@ func TestClient_STUNHandler(t *testing.T) {
 		c.stunHandler(stun.Event{
 			Message: stun.MustBuild(dataIndication),
 		})
-		found := false
-		for _, l := range logs.All() {
-			if l.Level != zap.ErrorLevel {
-				continue
-			}
-			if !strings.Contains(l.Message, "failed to parse while handling incoming STUN message") {
-				t.Errorf("unexpected message: %s", l.Message)
-			} else {
-				found = true
-			}
-		}
-		if !found {
-			t.Error("expected error message not found")
+		testutil.EnsureNoErrors(t, logs)
+		if n := c.Stats().MalformedSTUN; n != 1 {
+			t.Errorf("unexpected malformed count: %d", n)
 		}
 	})
-	t.Run("WriteErr", func(t *testing.T) {
-		stunClient := &testSTUN{}
-		core, logs := observer.New(zap.ErrorLevel)
-		connL, connR = testPipe(t, "server", "client")
-		timeout := time.Second * 10
-		c, createErr = New(Options{
-			Log:          zap.New(core),
-			Conn:         connR,
-			RTO:          timeout,
-			NoRetransmit: true,
-			STUN:         stunClient,
+	t.Run("Unpermitted", func(t *testing.T) {
+		c, _, a := newTestAllocation(t, Options{})
+		if _, err := a.Create(net.IPv4(127, 0, 0, 1)); err != nil {
+			t.Fatal(err)
+		}
+		c.stunHandler(stun.Event{
+			Message: stun.MustBuild(stun.TransactionID, dataIndication,
+				&turn.PeerAddress{IP: net.IPv4(127, 0, 0, 3), Port: 1001},
+				turn.Data{1, 2, 3},
+			),
 		})
-		if createErr != nil {
-			t.Error(createErr)
+		if n := c.Stats().UnpermittedData; n != 1 {
+			t.Errorf("unexpected unpermitted count: %d", n)
 		}
-		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
-			switch m.Type {
-			case turn.AllocateRequest:
-				f(stun.Event{
-					Message: stun.MustBuild(m,
-						stun.NewType(stun.MethodAllocate,
-							stun.ClassSuccessResponse,
-						),
-						&turn.RelayedAddress{
-							Port: 1113,
-							IP:   net.IPv4(127, 0, 0, 2),
-						},
-						stun.Fingerprint,
-					),
-				})
-			case stun.NewType(stun.MethodCreatePermission, stun.ClassRequest):
-				f(stun.Event{
-					Message: stun.MustBuild(m,
-						stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
-						stun.Fingerprint,
-					),
-				})
-			case stun.NewType(stun.MethodChannelBind, stun.ClassRequest):
-				f(stun.Event{
-					Message: stun.MustBuild(m,
-						stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
-					),
-				})
-			default:
-				t.Fatalf("unexpected type: %s", m.Type)
-			}
-			return nil
+		if err := a.SetReadDeadline(time.Now()); err != nil {
+			t.Fatal(err)
 		}
-		a, allocErr := c.Allocate()
-		if allocErr != nil {
-			t.Fatal(allocErr)
+		if _, _, err := a.ReadFrom(make([]byte, 10)); err != errTimeout {
+			t.Errorf("data should be dropped, got %v", err)
 		}
+	})
+	t.Run("Dropped", func(t *testing.T) {
+		c, _, a := newTestAllocation(t, Options{})
 		perm, err := a.Create(net.IPv4(127, 0, 0, 1))
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer mustClose(t, perm)
-		conn, err := perm.CreateUDP(&net.UDPAddr{
-			IP: net.IPv4(127, 0, 0, 1),
-		})
+		peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1001}
+		conn, err := perm.CreateUDP(peer)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if err = conn.peerR.Close(); err != nil {
-			t.Fatal(err)
+		for i := 0; i <= packetQueueSize; i++ {
+			c.stunHandler(stun.Event{
+				Message: stun.MustBuild(stun.TransactionID, dataIndication,
+					&turn.PeerAddress{IP: peer.IP, Port: peer.Port},
+					turn.Data{byte(i)},
+				),
+			})
 		}
-		if err = conn.peerL.Close(); err != nil {
-			t.Fatal(err)
+		if n := c.Stats().DroppedData; n != 1 {
+			t.Errorf("unexpected dropped count: %d", n)
 		}
-		c.stunHandler(stun.Event{
-			Message: stun.MustBuild(dataIndication,
-				&turn.PeerAddress{
-					IP: net.IPv4(127, 0, 0, 1),
-				},
-				&turn.Data{},
-			),
-		})
-		found := false
-		for _, l := range logs.All() {
-			if l.Level != zap.ErrorLevel {
-				continue
-			}
-			if !strings.HasPrefix(l.Message, "failed to write") {
-				t.Errorf("unexpected message: %s", l.Message)
-			} else {
-				found = true
-			}
+		buf := make([]byte, 10)
+		if n, readErr := conn.Read(buf); readErr != nil || n != 1 || buf[0] != 0 {
+			t.Errorf("unexpected read: %v %v", buf[:n], readErr)
 		}
-		if !found {
-			t.Error("expected error message not found")
+	})
+}
+
+func TestClient_handleTURNData(t *testing.T) {
+	c, _, a := newTestAllocation(t, Options{})
+	perm, err := a.Create(net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := perm.CreateUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1001})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.Bind(); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Malformed", func(t *testing.T) {
+		// Length is less than data length even with padding.
+		c.handleTURNData([]byte{0x40, 0x00, 0x00, 0x01, 1, 2, 3, 4, 5, 6, 7, 8})
+		if n := c.Stats().MalformedChannelData; n != 1 {
+			t.Errorf("unexpected malformed count: %d", n)
+		}
+	})
+	t.Run("NotChannelData", func(t *testing.T) {
+		c.handleTURNData([]byte{1, 2})
+		if s := c.Stats(); s.MalformedChannelData != 1 || s.UnpermittedData != 0 {
+			t.Errorf("unexpected stats: %+v", s)
+		}
+	})
+	t.Run("Unbound", func(t *testing.T) {
+		data := &turn.ChannelData{Number: conn.Binding() + 1, Data: []byte{1, 2, 3}}
+		data.Encode()
+		c.handleTURNData(data.Raw)
+		if n := c.Stats().UnpermittedData; n != 1 {
+			t.Errorf("unexpected unpermitted count: %d", n)
+		}
+	})
+	t.Run("Bound", func(t *testing.T) {
+		data := &turn.ChannelData{Number: conn.Binding(), Data: []byte{1, 2, 3}}
+		data.Encode()
+		c.handleTURNData(data.Raw)
+		// Buffer can be reused after handling.
+		data.Raw[4] = 0
+		buf := make([]byte, 10)
+		if n, readErr := conn.Read(buf); readErr != nil || !bytes.Equal(buf[:n], []byte{1, 2, 3}) {
+			t.Errorf("unexpected read: %v %v", buf[:n], readErr)
 		}
 	})
 }
 
+func TestClient_readUntilClosed(t *testing.T) {
+	connL, connR := net.Pipe()
+	c := &Client{log: zap.NewNop()}
+	done := make(chan struct{})
+	go c.readUntilClosed(connR, done)
+	go func() {
+		if _, err := connL.Write([]byte{0x40, 0x00, 0x00, 0x01, 1, 2, 3, 4, 5, 6, 7, 8}); err != nil {
+			t.Error(err)
+		}
+		mustClose(t, connL)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("should stop on EOF")
+	}
+	if n := c.Stats().MalformedChannelData; n != 1 {
+		t.Errorf("unexpected malformed count: %d", n)
+	}
+}
+
 func TestClient_sendChan(t *testing.T) {
 	connL, connR := net.Pipe()
 	c, createErr := New(Options{
@@ -638,6 +693,103 @@ func TestClient_do(t *testing.T) {
 	}
 }
 
+type testContextSTUN struct {
+	testSTUN
+	doContext func(ctx context.Context, m *stun.Message, f func(e stun.Event)) error
+}
+
+func (t testContextSTUN) DoContext(ctx context.Context, m *stun.Message, f func(e stun.Event)) error {
+	return t.doContext(ctx, m, f)
+}
+
+func TestClient_doContext(t *testing.T) {
+	connL, connR := net.Pipe()
+	defer mustClose(t, connL)
+	stunClient := &testSTUN{}
+	c, createErr := New(Options{
+		STUN: stunClient,
+		Conn: connR,
+	})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	t.Run("Canceled", func(t *testing.T) {
+		var (
+			release = make(chan struct{})
+			deleted = make(chan struct{})
+		)
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			if m.Type.Method == stun.MethodRefresh {
+				// Allocation is deleted after late response.
+				var lifetime turn.Lifetime
+				if err := lifetime.GetFrom(m); err != nil || lifetime.Duration != 0 {
+					t.Errorf("unexpected lifetime: %s (%v)", lifetime.Duration, err)
+				}
+				defer close(deleted)
+			} else {
+				<-release
+			}
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse)),
+			})
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+		if _, err := c.AllocateContext(ctx); err != context.DeadlineExceeded {
+			t.Errorf("unexpected error: %v", err)
+		}
+		close(release)
+		select {
+		case <-deleted:
+		case <-time.After(time.Second * 5):
+			t.Fatal("abandoned allocation should be deleted")
+		}
+	})
+	t.Run("Done", func(t *testing.T) {
+		stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse)),
+			})
+			return nil
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		req := stun.MustBuild(stun.TransactionID, turn.AllocateRequest)
+		res := stun.New()
+		if err := c.doContext(ctx, req, res); err != nil {
+			t.Fatal(err)
+		}
+		if res.TransactionID != req.TransactionID {
+			t.Error("unexpected response")
+		}
+		cancel()
+		if err := c.doContext(ctx, req, res); err != context.Canceled {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("ContextSTUNClient", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		called := false
+		c.stun = testContextSTUN{
+			doContext: func(doCtx context.Context, m *stun.Message, f func(e stun.Event)) error {
+				called = doCtx == ctx
+				f(stun.Event{
+					Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse)),
+				})
+				return nil
+			},
+		}
+		defer func() { c.stun = stunClient }()
+		if err := c.doContext(ctx, stun.MustBuild(stun.TransactionID, turn.AllocateRequest), nil); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Error("DoContext should be called with context")
+		}
+	})
+}
+
 func TestClient_Close(t *testing.T) {
 	t.Run("Default", func(t *testing.T) {
 		connL, connR := net.Pipe()
@@ -673,4 +825,30 @@ func TestClient_Close(t *testing.T) {
 			t.Fatal(err)
 		}
 	})
+	t.Run("ManualClose", func(t *testing.T) {
+		connL, connR := net.Pipe()
+		defer mustClose(t, connL)
+		defer mustClose(t, connR)
+		c, createErr := New(Options{
+			Conn:            connR,
+			ConnManualClose: true,
+		})
+		if createErr != nil {
+			t.Fatal(createErr)
+		}
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// Connection is left open and not read by client.
+		go func() {
+			if _, writeErr := connL.Write([]byte{1, 2, 3}); writeErr != nil {
+				t.Error(writeErr)
+			}
+		}()
+		_ = connR.SetReadDeadline(time.Now().Add(time.Second * 5))
+		buf := make([]byte, 10)
+		if n, readErr := connR.Read(buf); readErr != nil || n != 3 {
+			t.Errorf("unexpected read: %d %v", n, readErr)
+		}
+	})
 }
@@ -0,0 +1,95 @@
+package turnc
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+)
+
+// ALPN is the Application-Layer Protocol Negotiation protocol ID for
+// TURN over TLS, as defined in RFC 7443 Section 6.
+const ALPN = "stun.turn"
+
+// TLSConfig returns copy of provided config (or new one if nil) that is
+// ready to be used for TURN over TLS connection to server with addr.
+//
+// The ServerName is set to addr host if not set and ALPN is added to
+// NextProtos. Set RootCAs and Certificates on provided config for custom
+// root pools and client certificates.
+func TLSConfig(config *tls.Config, addr string) (*tls.Config, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	for _, proto := range config.NextProtos {
+		if proto == ALPN {
+			return config, nil
+		}
+	}
+	config.NextProtos = append(config.NextProtos, ALPN)
+	return config, nil
+}
+
+// DialTLS connects to TURN server on addr over TLS ("turns:" URI scheme)
+// and creates new client on that connection with provided options.
+//
+// The config is prepared via TLSConfig, so server name is verified.
+// On redirect, the server name of alternate server is taken from
+// ALTERNATE-DOMAIN if present. The Options.Conn must be nil.
+func DialTLS(addr string, config *tls.Config, o Options) (*Client, error) {
+	if o.Conn != nil {
+		return nil, errors.New("connection should not be provided")
+	}
+	config, err := TLSConfig(config, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	o.Conn = conn
+	// Server is changed on redirect from other goroutine.
+	var serverMux sync.Mutex
+	if o.DialData == nil {
+		// Data connections follow redirect to alternate server.
+		o.DialData = func() (net.Conn, error) {
+			serverMux.Lock()
+			dataAddr, dataConfig := addr, config
+			serverMux.Unlock()
+			return tls.Dial("tcp", dataAddr, dataConfig)
+		}
+	}
+	if o.DialAlternate == nil {
+		o.DialAlternate = func(alternate, domain string) (net.Conn, error) {
+			serverMux.Lock()
+			altConfig := config.Clone()
+			serverMux.Unlock()
+			if domain != "" {
+				altConfig.ServerName = domain
+			}
+			altConn, err := tls.Dial("tcp", alternate, altConfig)
+			if err != nil {
+				return nil, err
+			}
+			serverMux.Lock()
+			addr, config = alternate, altConfig
+			serverMux.Unlock()
+			return altConn, nil
+		}
+	}
+	c, err := New(o)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,170 @@
+package turnc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"gortc.io/turnc/internal/testutil"
+)
+
+// testCertificate generates self-signed certificate for localhost.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}, pool
+}
+
+func TestTLSConfig(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		cfg, err := TLSConfig(nil, "example.com:5349")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.ServerName != "example.com" {
+			t.Errorf("unexpected server name %q", cfg.ServerName)
+		}
+		if len(cfg.NextProtos) != 1 || cfg.NextProtos[0] != ALPN {
+			t.Errorf("unexpected next protos %v", cfg.NextProtos)
+		}
+	})
+	t.Run("Custom", func(t *testing.T) {
+		original := &tls.Config{
+			ServerName: "turn.example.com",
+			NextProtos: []string{ALPN},
+		}
+		cfg, err := TLSConfig(original, "127.0.0.1:5349")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg == original {
+			t.Error("config should be copied")
+		}
+		if cfg.ServerName != "turn.example.com" {
+			t.Errorf("unexpected server name %q", cfg.ServerName)
+		}
+		if len(cfg.NextProtos) != 1 {
+			t.Errorf("unexpected next protos %v", cfg.NextProtos)
+		}
+	})
+	t.Run("BadAddr", func(t *testing.T) {
+		if _, err := TLSConfig(nil, "example.com"); err == nil {
+			t.Error("should error")
+		}
+	})
+}
+
+func TestDialTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		NextProtos:   []string{ALPN},
+	}
+	ln, err := tls.Listen("tcp", "localhost:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mustClose(t, ln)
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("localhost", port)
+	timeout := time.Second * 10
+	t.Run("ConnProvided", func(t *testing.T) {
+		connL, connR := net.Pipe()
+		defer mustClose(t, connL)
+		if _, dialErr := DialTLS(addr, nil, Options{Conn: connR}); dialErr == nil {
+			t.Error("should error")
+		}
+	})
+	t.Run("UnknownAuthority", func(t *testing.T) {
+		go func() {
+			conn, acceptErr := ln.Accept()
+			if acceptErr != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}()
+		if _, dialErr := DialTLS(addr, nil, Options{}); dialErr == nil {
+			t.Error("should error")
+		}
+	})
+	t.Run("Echo", func(t *testing.T) {
+		core, logs := observer.New(zapcore.DebugLevel)
+		negotiated := make(chan string, 1)
+		go func() {
+			conn, acceptErr := ln.Accept()
+			if acceptErr != nil {
+				t.Error(acceptErr)
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if handshakeErr := tlsConn.Handshake(); handshakeErr != nil {
+				t.Error(handshakeErr)
+				return
+			}
+			negotiated <- tlsConn.ConnectionState().NegotiatedProtocol
+			serveStream(t, conn)
+		}()
+		c, dialErr := DialTLS(addr, &tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{cert},
+		}, Options{
+			Log:          zap.New(core),
+			RTO:          timeout,
+			NoRetransmit: true,
+		})
+		if dialErr != nil {
+			t.Fatal(dialErr)
+		}
+		checkEcho(t, c, timeout)
+		if proto := <-negotiated; proto != ALPN {
+			t.Errorf("unexpected negotiated protocol %q", proto)
+		}
+		testutil.EnsureNoErrors(t, logs)
+		mustClose(t, c)
+	})
+}
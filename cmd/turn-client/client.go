@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 
@@ -20,10 +23,55 @@ var (
 		"localhost:56780",
 		"peer address",
 	)
+	network = flag.String("net", "udp",
+		"network to use for turn server connection (udp or tcp)",
+	)
 	username = flag.String("u", "user", "username")
 	password = flag.String("p", "secret", "password")
+	secret   = flag.String("secret", "", "TURN REST API shared secret, used instead of password")
+
+	useTLS     = flag.Bool("tls", false, "use TLS for turn server connection")
+	serverName = flag.String("servername", "", "server name for TLS verification (defaults to server host)")
+	caFile     = flag.String("ca", "", "path to PEM-encoded root CA certificates for TLS")
+	certFile   = flag.String("cert", "", "path to PEM-encoded TLS client certificate")
+	keyFile    = flag.String("key", "", "path to PEM-encoded TLS client key")
 )
 
+func tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: *serverName,
+	}
+	if *caFile != "" {
+		data, err := ioutil.ReadFile(*caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", *caFile)
+		}
+	}
+	if *certFile != "" || *keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return turnc.TLSConfig(cfg, *server)
+}
+
+func dial() (net.Conn, error) {
+	if !*useTLS {
+		return net.Dial(*network, *server)
+	}
+	cfg, err := tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp", *server, cfg)
+}
+
 func main() {
 	flag.Parse()
 	l, lErr := zap.NewDevelopment()
@@ -62,27 +110,27 @@ func main() {
 			logger.Infof("echoed back [%s]", addr)
 		}
 	}
-	if *password == "" {
+	if *password == "" && *secret == "" {
 		fmt.Fprintln(os.Stderr, "No password set, auth is required.")
 		flag.Usage()
 		os.Exit(2)
 	}
-	// Resolving to TURN server.
-	raddr, err := net.ResolveUDPAddr("udp", *server)
-	if err != nil {
-		panic(err)
-	}
-	c, err := net.DialUDP("udp", nil, raddr)
+	// Connecting to TURN server.
+	c, err := dial()
 	if err != nil {
 		panic(err)
 	}
 	logger.Infof("dial server %s -> %s", c.LocalAddr(), c.RemoteAddr())
-	client, clientErr := turnc.New(turnc.Options{
+	options := turnc.Options{
 		Log:      l,
 		Conn:     c,
 		Username: *username,
 		Password: *password,
-	})
+	}
+	if *secret != "" {
+		options.Credentials = turnc.RESTCredentials(*secret, *username, 0)
+	}
+	client, clientErr := turnc.New(options)
 	if clientErr != nil {
 		panic(clientErr)
 	}
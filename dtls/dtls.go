@@ -0,0 +1,87 @@
+// Package dtls implements TURN over DTLS transport (RFC 7350) for turnc.
+//
+// It is separate package, so turnc users that don't need DTLS don't
+// depend on DTLS implementation. Any DTLS connection that implements
+// net.Conn can also be passed to turnc.New directly, because DTLS
+// preserves message boundaries.
+package dtls
+
+import (
+	"errors"
+	"net"
+
+	piondtls "github.com/pion/dtls/v2"
+
+	"gortc.io/turnc"
+)
+
+// ClientConfig returns copy of provided config (or new one if nil) that
+// is ready to be used for TURN over DTLS connection to server with addr.
+//
+// Like turnc.TLSConfig, sets ServerName to addr host if not set and adds
+// turnc.ALPN to SupportedProtocols.
+func ClientConfig(config *piondtls.Config, addr string) (*piondtls.Config, error) {
+	var c piondtls.Config
+	if config != nil {
+		c = *config
+	}
+	if c.ServerName == "" && !c.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		c.ServerName = host
+	}
+	for _, proto := range c.SupportedProtocols {
+		if proto == turnc.ALPN {
+			return &c, nil
+		}
+	}
+	c.SupportedProtocols = append(append([]string(nil), c.SupportedProtocols...), turnc.ALPN)
+	return &c, nil
+}
+
+// Dial connects to TURN server on addr over DTLS and creates new client
+// on that connection with provided options.
+//
+// DTLS preserves message boundaries, so all STUN and ChannelData messages
+// are sent in DTLS records without additional framing. Like
+// turnc.DialTLS, follows redirects with ALTERNATE-DOMAIN as server name.
+// The Options.Conn must be nil.
+func Dial(addr string, config *piondtls.Config, o turnc.Options) (*turnc.Client, error) {
+	if o.Conn != nil {
+		return nil, errors.New("connection should not be provided")
+	}
+	config, err := ClientConfig(config, addr)
+	if err != nil {
+		return nil, err
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := piondtls.Dial("udp", raddr, config)
+	if err != nil {
+		return nil, err
+	}
+	o.Conn = conn
+	if o.DialAlternate == nil {
+		o.DialAlternate = func(alternate, domain string) (net.Conn, error) {
+			altConfig := *config
+			if domain != "" {
+				altConfig.ServerName = domain
+			}
+			altAddr, err := net.ResolveUDPAddr("udp", alternate)
+			if err != nil {
+				return nil, err
+			}
+			return piondtls.Dial("udp", altAddr, &altConfig)
+		}
+	}
+	c, err := turnc.New(o)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,182 @@
+package dtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	piondtls "github.com/pion/dtls/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+	"gortc.io/turnc"
+	"gortc.io/turnc/internal/testutil"
+)
+
+func mustClose(t *testing.T, closer io.Closer) {
+	t.Helper()
+	if err := closer.Close(); err != nil {
+		t.Errorf("failed to close: %v", err)
+	}
+}
+
+// testCertificate generates self-signed certificate for localhost.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}, pool
+}
+
+// serveSuccess responds to each STUN request from conn with success
+// response with relayed address.
+func serveSuccess(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer mustClose(t, conn)
+	buf := make([]byte, 1500)
+	for {
+		n, readErr := conn.Read(buf)
+		if readErr != nil {
+			return
+		}
+		m := &stun.Message{Raw: buf[:n]}
+		if decodeErr := m.Decode(); decodeErr != nil {
+			t.Error(decodeErr)
+			return
+		}
+		res := stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+			&turn.RelayedAddress{
+				IP:   net.IPv4(127, 0, 0, 1),
+				Port: 1001,
+			},
+			stun.Fingerprint,
+		)
+		if _, writeErr := conn.Write(res.Raw); writeErr != nil {
+			t.Error(writeErr)
+		}
+	}
+}
+
+func TestClientConfig(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		cfg, err := ClientConfig(nil, "example.com:5349")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.ServerName != "example.com" {
+			t.Errorf("unexpected server name %q", cfg.ServerName)
+		}
+		if len(cfg.SupportedProtocols) != 1 || cfg.SupportedProtocols[0] != turnc.ALPN {
+			t.Errorf("unexpected protocols %v", cfg.SupportedProtocols)
+		}
+	})
+	t.Run("Insecure", func(t *testing.T) {
+		cfg, err := ClientConfig(&piondtls.Config{
+			InsecureSkipVerify: true,
+		}, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.ServerName != "" {
+			t.Errorf("unexpected server name %q", cfg.ServerName)
+		}
+	})
+	t.Run("BadAddr", func(t *testing.T) {
+		if _, err := ClientConfig(nil, "example.com"); err == nil {
+			t.Error("should error")
+		}
+	})
+}
+
+func TestDial(t *testing.T) {
+	cert, pool := testCertificate(t)
+	ln, err := piondtls.Listen("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &piondtls.Config{
+		Certificates:       []tls.Certificate{cert},
+		SupportedProtocols: []string{turnc.ALPN},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mustClose(t, ln)
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("localhost", port)
+	timeout := time.Second * 10
+	t.Run("ConnProvided", func(t *testing.T) {
+		connL, connR := net.Pipe()
+		defer mustClose(t, connL)
+		if _, dialErr := Dial(addr, nil, turnc.Options{Conn: connR}); dialErr == nil {
+			t.Error("should error")
+		}
+	})
+	t.Run("Allocate", func(t *testing.T) {
+		core, logs := observer.New(zapcore.DebugLevel)
+		go func() {
+			conn, acceptErr := ln.Accept()
+			if acceptErr != nil {
+				t.Error(acceptErr)
+				return
+			}
+			serveSuccess(t, conn)
+		}()
+		c, dialErr := Dial(addr, &piondtls.Config{
+			RootCAs: pool,
+		}, turnc.Options{
+			Log:          zap.New(core),
+			RTO:          timeout,
+			NoRetransmit: true,
+		})
+		if dialErr != nil {
+			t.Fatal(dialErr)
+		}
+		a, allocErr := c.Allocate()
+		if allocErr != nil {
+			t.Fatal(allocErr)
+		}
+		if r := a.Relayed(); r.Port != 1001 {
+			t.Errorf("unexpected relayed addr: %s", r)
+		}
+		testutil.EnsureNoErrors(t, logs)
+		mustClose(t, c)
+	})
+}
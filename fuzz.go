@@ -0,0 +1,86 @@
+//go:build gofuzz
+// +build gofuzz
+
+package turnc
+
+import (
+	"net"
+
+	"go.uber.org/zap"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+)
+
+// Fuzz targets for go-fuzz over receive path, see Makefile.
+
+// newFuzzClient returns client with allocation, permission and
+// connection to 127.0.0.1:1001 that is bound to turn.MinChannelNumber.
+func newFuzzClient() *Client {
+	c := &Client{log: zap.NewNop()}
+	a := &Allocation{
+		log:      c.log,
+		client:   c,
+		packets:  newPacketQueue(),
+		channels: make(map[turn.ChannelNumber]*Connection),
+	}
+	p := &Permission{
+		log:    c.log,
+		client: c,
+		ip:     net.IPv4(127, 0, 0, 1),
+	}
+	conn := p.newConnection(turn.PeerAddress{IP: p.ip, Port: 1001})
+	conn.number = turn.MinChannelNumber
+	p.conn = append(p.conn, conn)
+	a.perms = append(a.perms, p)
+	a.channels[conn.number] = conn
+	c.alloc = a
+	return c
+}
+
+// newFuzzMultiplexer returns multiplexer without connection, discarding
+// de-multiplexed data.
+func newFuzzMultiplexer() *multiplexer {
+	m := &multiplexer{log: zap.NewNop(), stats: new(stats), message: stun.New()}
+	m.stunL, m.stunR = net.Pipe()
+	m.turnL, m.turnR = net.Pipe()
+	m.dataL, m.dataR = net.Pipe()
+	go discardLogged(m.log, "failed to discard stunL", m.stunL)
+	go discardLogged(m.log, "failed to discard turnL", m.turnL)
+	go discardLogged(m.log, "failed to discard dataL", m.dataL)
+	return m
+}
+
+var (
+	fuzzClient      = newFuzzClient()
+	fuzzMultiplexer = newFuzzMultiplexer()
+)
+
+// FuzzMultiplexer fuzzes de-multiplexing of data from connection.
+func FuzzMultiplexer(data []byte) int {
+	fuzzMultiplexer.handle(data)
+	if stun.IsMessage(data) || turn.IsChannelData(data) {
+		return 1
+	}
+	return 0
+}
+
+// FuzzChannelData fuzzes handling of data from TURN connection.
+func FuzzChannelData(data []byte) int {
+	fuzzClient.handleTURNData(data)
+	if turn.IsChannelData(data) {
+		return 1
+	}
+	return 0
+}
+
+// FuzzSTUNHandler fuzzes handling of STUN messages that are not
+// responses, e.g. data indications.
+func FuzzSTUNHandler(data []byte) int {
+	m := stun.New()
+	if _, err := m.Write(data); err != nil {
+		return 0
+	}
+	fuzzClient.stunHandler(stun.Event{Message: m})
+	return 1
+}
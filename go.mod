@@ -1,8 +1,10 @@
 module gortc.io/turnc
 
-go 1.12
+go 1.14
 
 require (
+	github.com/pion/dtls/v2 v2.2.12
+	github.com/pion/transport/v2 v2.2.10 // indirect
 	go.uber.org/zap v1.15.0
 	gortc.io/stun v1.22.2
 	gortc.io/turn v0.11.2
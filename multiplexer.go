@@ -4,6 +4,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"sync/atomic"
 
 	"go.uber.org/zap"
 
@@ -15,8 +16,10 @@ import (
 // from one connection into separate ones.
 type multiplexer struct {
 	log      *zap.Logger
+	stats    *stats
 	capacity int
 	conn     net.Conn
+	message  *stun.Message // for validation of STUN messages
 
 	stunL, stunR net.Conn
 	turnL, turnR net.Conn
@@ -25,8 +28,8 @@ type multiplexer struct {
 
 const packetSize = 1500
 
-func newMultiplexer(conn net.Conn, log *zap.Logger) *multiplexer {
-	m := &multiplexer{conn: conn, capacity: packetSize, log: log}
+func newMultiplexer(conn net.Conn, log *zap.Logger, s *stats) *multiplexer {
+	m := &multiplexer{conn: conn, capacity: packetSize, log: log, stats: s, message: stun.New()}
 	m.stunL, m.stunR = net.Pipe()
 	m.turnL, m.turnR = net.Pipe()
 	m.dataL, m.dataR = net.Pipe()
@@ -69,21 +72,31 @@ func (m *multiplexer) readUntilClosed() {
 			m.close()
 			break
 		}
-		data := buf[:n]
-		conn := m.dataR
-		switch {
-		case stun.IsMessage(data):
-			m.log.Debug("mux: got STUN data")
-			conn = m.stunR
-		case turn.IsChannelData(data):
-			m.log.Debug("mux: got TURN data")
-			conn = m.turnR
-		default:
-			m.log.Debug("mux: got APP data")
-		}
-		_, err = conn.Write(data)
-		if err != nil {
-			m.log.Warn("failed to write", zap.Error(err))
+		m.handle(buf[:n])
+	}
+}
+
+// handle passes data to STUN, TURN or application data connection,
+// dropping STUN messages that fail to decode.
+func (m *multiplexer) handle(data []byte) {
+	conn := m.dataR
+	switch {
+	case stun.IsMessage(data):
+		m.log.Debug("mux: got STUN data")
+		m.message.Raw = append(m.message.Raw[:0], data...)
+		if err := m.message.Decode(); err != nil {
+			atomic.AddUint64(&m.stats.malformedSTUN, 1)
+			m.log.Debug("mux: dropped malformed STUN message", zap.Error(err))
+			return
 		}
+		conn = m.stunR
+	case turn.IsChannelData(data):
+		m.log.Debug("mux: got TURN data")
+		conn = m.turnR
+	default:
+		m.log.Debug("mux: got APP data")
+	}
+	if _, err := conn.Write(data); err != nil {
+		m.log.Warn("failed to write", zap.Error(err))
 	}
 }
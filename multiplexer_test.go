@@ -3,6 +3,7 @@ package turnc
 import (
 	"io"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -44,7 +45,7 @@ func TestMultiplexer(t *testing.T) {
 	t.Run("AppData", func(t *testing.T) {
 		core, logs := observer.New(zap.ErrorLevel)
 		connL, connR := net.Pipe()
-		m := newMultiplexer(connR, zap.New(core))
+		m := newMultiplexer(connR, zap.New(core), new(stats))
 		go func() {
 			if err := connL.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
 				t.Error(err)
@@ -64,7 +65,7 @@ func TestMultiplexer(t *testing.T) {
 	t.Run("Write error", func(t *testing.T) {
 		core, logs := observer.New(zap.WarnLevel)
 		connL, connR := net.Pipe()
-		m := newMultiplexer(connR, zap.New(core))
+		m := newMultiplexer(connR, zap.New(core), new(stats))
 		if err := m.dataR.Close(); err != nil {
 			t.Error(err)
 		}
@@ -87,4 +88,22 @@ func TestMultiplexer(t *testing.T) {
 			}
 		}
 	})
+	t.Run("MalformedSTUN", func(t *testing.T) {
+		core, logs := observer.New(zap.WarnLevel)
+		connL, connR := net.Pipe()
+		s := new(stats)
+		m := newMultiplexer(connR, zap.New(core), s)
+		defer mustClose(t, connL)
+		// Header with magic cookie and length that exceeds message.
+		m.handle([]byte{
+			0x00, 0x01, 0x00, 0x10, 0x21, 0x12, 0xa4, 0x42,
+			1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12,
+		})
+		if n := atomic.LoadUint64(&s.malformedSTUN); n != 1 {
+			t.Errorf("unexpected malformed count: %d", n)
+		}
+		if logs.Len() > 0 {
+			t.Error("no logs expected")
+		}
+	})
 }
@@ -0,0 +1,127 @@
+package turnc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClosed means that connection is closed.
+var ErrClosed = errors.New("use of closed connection")
+
+// timeoutError is returned when read deadline is exceeded.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errTimeout net.Error = timeoutError{}
+
+// packetQueueSize is maximum count of packets that are pending read.
+const packetQueueSize = 64
+
+type packet struct {
+	data []byte
+	addr net.Addr
+}
+
+// packetQueue is bounded queue of packets from peers with read deadline
+// support, used to implement net.PacketConn.
+//
+// Packets are dropped if queue is full, as UDP socket buffers do.
+type packetQueue struct {
+	packets chan packet
+	done    chan struct{}
+	once    sync.Once
+
+	mux      sync.Mutex
+	deadline time.Time
+	changed  chan struct{} // closed and replaced on deadline change
+}
+
+func newPacketQueue() *packetQueue {
+	return &packetQueue{
+		packets: make(chan packet, packetQueueSize),
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+}
+
+// push copies data to queue, returning false if packet was dropped.
+func (q *packetQueue) push(data []byte, addr net.Addr) bool {
+	select {
+	case <-q.done:
+		return false
+	default:
+	}
+	p := packet{
+		data: append([]byte(nil), data...),
+		addr: addr,
+	}
+	select {
+	case q.packets <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+// read reads packet to b, blocking until packet is available, queue is
+// closed or read deadline is exceeded.
+func (q *packetQueue) read(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, changed, err := q.readOnce(b)
+		if !changed {
+			return n, addr, err
+		}
+	}
+}
+
+// readOnce is single read attempt that is interrupted if deadline is
+// changed, which is reported via changed result.
+func (q *packetQueue) readOnce(b []byte) (n int, addr net.Addr, changed bool, err error) {
+	select {
+	case <-q.done:
+		return 0, nil, false, ErrClosed
+	default:
+	}
+	q.mux.Lock()
+	deadline, deadlineChanged := q.deadline, q.changed
+	q.mux.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, false, errTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p := <-q.packets:
+		return copy(b, p.data), p.addr, false, nil
+	case <-q.done:
+		return 0, nil, false, ErrClosed
+	case <-timeout:
+		return 0, nil, false, errTimeout
+	case <-deadlineChanged:
+		return 0, nil, true, nil
+	}
+}
+
+func (q *packetQueue) setReadDeadline(t time.Time) {
+	q.mux.Lock()
+	q.deadline = t
+	close(q.changed)
+	q.changed = make(chan struct{})
+	q.mux.Unlock()
+}
+
+func (q *packetQueue) close() {
+	q.once.Do(func() {
+		close(q.done)
+	})
+}
@@ -0,0 +1,94 @@
+package turnc
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPacketQueue(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1001}
+	t.Run("Read", func(t *testing.T) {
+		q := newPacketQueue()
+		data := []byte("hello")
+		if !q.push(data, addr) {
+			t.Fatal("should push")
+		}
+		data[0] = 'j' // should be copied
+		buf := make([]byte, 1024)
+		n, gotAddr, err := q.read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], []byte("hello")) {
+			t.Errorf("unexpected data: %q", buf[:n])
+		}
+		if gotAddr != addr {
+			t.Errorf("unexpected addr: %s", gotAddr)
+		}
+	})
+	t.Run("Full", func(t *testing.T) {
+		q := newPacketQueue()
+		for i := 0; i < packetQueueSize; i++ {
+			if !q.push([]byte{1}, addr) {
+				t.Fatal("should push")
+			}
+		}
+		if q.push([]byte{1}, addr) {
+			t.Error("should drop")
+		}
+	})
+	t.Run("Deadline", func(t *testing.T) {
+		q := newPacketQueue()
+		q.setReadDeadline(time.Now().Add(time.Millisecond * 10))
+		_, _, err := q.read(make([]byte, 10))
+		if nErr, ok := err.(net.Error); !ok || !nErr.Timeout() {
+			t.Errorf("unexpected error: %v", err)
+		}
+		q.setReadDeadline(time.Now().Add(-time.Second))
+		if _, _, err = q.read(make([]byte, 10)); err != errTimeout {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("DeadlineChanged", func(t *testing.T) {
+		q := newPacketQueue()
+		q.setReadDeadline(time.Now().Add(time.Hour))
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := q.read(make([]byte, 10))
+			done <- err
+		}()
+		time.Sleep(time.Millisecond * 10)
+		q.setReadDeadline(time.Now())
+		select {
+		case err := <-done:
+			if err != errTimeout {
+				t.Errorf("unexpected error: %v", err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("read not unblocked")
+		}
+	})
+	t.Run("Close", func(t *testing.T) {
+		q := newPacketQueue()
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := q.read(make([]byte, 10))
+			done <- err
+		}()
+		q.close()
+		q.close() // should be no-op
+		select {
+		case err := <-done:
+			if err != ErrClosed {
+				t.Errorf("unexpected error: %v", err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("read not unblocked")
+		}
+		if q.push([]byte{1}, addr) {
+			t.Error("should not push after close")
+		}
+	})
+}
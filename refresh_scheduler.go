@@ -0,0 +1,318 @@
+package turnc
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gortc.io/turn"
+)
+
+const (
+	// refreshWorkers is maximum count of concurrent refresh transactions.
+	refreshWorkers = 4
+	// minRetryInterval and maxRetryInterval bound exponential backoff of
+	// failed refresh retries.
+	minRetryInterval = time.Second
+	maxRetryInterval = time.Minute
+	// maxRetryBackoff is count of failures since which retry interval is
+	// not increased, because minRetryInterval << 6 exceeds maxRetryInterval.
+	maxRetryBackoff = 7
+	// maxCoalesceWindow limits how early permission refresh can be done
+	// to be coalesced with other permission refreshes.
+	maxCoalesceWindow = time.Second * 10
+)
+
+// refreshTask is scheduled refresh of allocation, permission or channel
+// binding.
+type refreshTask struct {
+	log      *zap.Logger
+	name     string               // "allocation", "permission" or "bind"
+	interval func() time.Duration // returns duration before next refresh
+	refresh  func() error         // nil for permission
+	perm     *Permission          // set for permission refresh
+	deadline time.Time            // protected with scheduler mux
+	failures int                  // protected with scheduler mux
+	index    int                  // in heap, -1 if not scheduled
+	stopped  bool                 // protected with scheduler mux
+	wg       sync.WaitGroup       // in-flight refresh
+}
+
+// coalesceWindow returns duration before deadline in which task can be
+// coalesced with other tasks.
+func (t *refreshTask) coalesceWindow() time.Duration {
+	w := t.interval() / 4
+	if w > maxCoalesceWindow {
+		w = maxCoalesceWindow
+	}
+	return w
+}
+
+// retryInterval returns duration before retry of failed refresh, which is
+// exponentially increased with each failure, but not greater than regular
+// refresh interval.
+func retryInterval(failures int, interval time.Duration) time.Duration {
+	d := maxRetryInterval
+	if failures < maxRetryBackoff {
+		d = minRetryInterval << uint(failures-1)
+	}
+	if d > maxRetryInterval {
+		d = maxRetryInterval
+	}
+	if d > interval {
+		d = interval
+	}
+	return d
+}
+
+type taskHeap []*refreshTask
+
+func (h taskHeap) Len() int           { return len(h) }
+func (h taskHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h taskHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *taskHeap) Push(x interface{}) {
+	t := x.(*refreshTask)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *taskHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*h = old[:n-1]
+	return t
+}
+
+// scheduler owns refresh deadlines of all allocations, permissions and
+// channel bindings of client in timer heap, running due refreshes by
+// limited count of workers.
+//
+// Due permission refreshes are coalesced into single CreatePermission
+// request with multiple peer addresses.
+type scheduler struct {
+	mux     sync.Mutex
+	tasks   taskHeap
+	wake    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	workers chan struct{}
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		workers: make(chan struct{}, refreshWorkers),
+	}
+	go s.run()
+	return s
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// add schedules task after its interval.
+func (s *scheduler) add(t *refreshTask) {
+	s.mux.Lock()
+	t.index = -1
+	t.deadline = time.Now().Add(t.interval())
+	heap.Push(&s.tasks, t)
+	s.mux.Unlock()
+	s.notify()
+}
+
+// remove stops task, waiting for in-flight refresh.
+func (s *scheduler) remove(t *refreshTask) {
+	s.mux.Lock()
+	t.stopped = true
+	if t.index >= 0 {
+		heap.Remove(&s.tasks, t.index)
+	}
+	s.mux.Unlock()
+	t.wg.Wait()
+}
+
+func (s *scheduler) close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+func (s *scheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		s.mux.Lock()
+		wait := time.Hour
+		if len(s.tasks) > 0 {
+			wait = time.Until(s.tasks[0].deadline)
+		}
+		s.mux.Unlock()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+			s.runDue()
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// due removes due tasks from heap, grouping permission tasks together.
+func (s *scheduler) due() [][]*refreshTask {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var (
+		now    = time.Now()
+		groups [][]*refreshTask
+		perms  []*refreshTask
+	)
+	for len(s.tasks) > 0 && !s.tasks[0].deadline.After(now) {
+		t := heap.Pop(&s.tasks).(*refreshTask)
+		t.wg.Add(1)
+		if t.perm != nil {
+			perms = append(perms, t)
+			continue
+		}
+		groups = append(groups, []*refreshTask{t})
+	}
+	if len(perms) > 0 {
+		// Coalescing with permissions that are due soon.
+		var soon []*refreshTask
+		for _, t := range s.tasks {
+			if t.perm != nil && t.deadline.Sub(now) <= t.coalesceWindow() {
+				soon = append(soon, t)
+			}
+		}
+		for _, t := range soon {
+			heap.Remove(&s.tasks, t.index)
+			t.wg.Add(1)
+			perms = append(perms, t)
+		}
+		groups = append(groups, perms)
+	}
+	return groups
+}
+
+func (s *scheduler) runDue() {
+	for _, group := range s.due() {
+		select {
+		case s.workers <- struct{}{}:
+		case <-s.done:
+			for _, t := range group {
+				t.wg.Done()
+			}
+			continue
+		}
+		go func(group []*refreshTask) {
+			errs := refreshGroup(group)
+			<-s.workers
+			s.reschedule(group, errs)
+		}(group)
+	}
+}
+
+// refreshGroup performs refresh of single task or coalesced permissions,
+// returning error of each task.
+//
+// If server rejects coalesced permissions with error response, e.g. 403
+// (Forbidden) for one of peers, they are refreshed separately, so only
+// rejected permissions fail. Lost allocation is recovered if enabled.
+func refreshGroup(group []*refreshTask) []error {
+	errs := make([]error, len(group))
+	if group[0].perm == nil {
+		errs[0] = group[0].refresh()
+		return errs
+	}
+	var (
+		a        = group[0].perm.client.alloc
+		gen      = a.generation()
+		err      = refreshPermissions(group)
+		rejected *Error
+	)
+	switch {
+	case errors.Is(err, ErrAllocationMismatch):
+		err = a.recoverLost(gen, err)
+	case len(group) > 1 && errors.As(err, &rejected):
+		group[0].log.Debug("coalesced permissions rejected", zap.Error(err))
+		for i := range group {
+			errs[i] = refreshPermissions(group[i : i+1])
+		}
+		return errs
+	}
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// refreshPermissions refreshes permissions of tasks with single
+// CreatePermission transaction per batch.
+func refreshPermissions(group []*refreshTask) error {
+	var (
+		a     = group[0].perm.client.alloc
+		peers = make([]turn.PeerAddress, 0, len(group))
+	)
+	for _, t := range group {
+		peers = append(peers, turn.PeerAddress{IP: t.perm.ip})
+	}
+	if err := a.allocate(context.Background(), peers...); err != nil {
+		return err
+	}
+	for _, t := range group {
+		t.perm.setRefreshed()
+	}
+	return nil
+}
+
+func (s *scheduler) reschedule(group []*refreshTask, errs []error) {
+	s.mux.Lock()
+	now := time.Now()
+	for i, t := range group {
+		err := errs[i]
+		if err != nil {
+			t.log.Error("failed to refresh "+t.name, zap.Error(err))
+		} else {
+			t.log.Debug(t.name + " refreshed")
+		}
+		if t.stopped {
+			t.wg.Done()
+			continue
+		}
+		interval := t.interval()
+		if err != nil {
+			t.failures++
+			interval = retryInterval(t.failures, interval)
+		} else {
+			t.failures = 0
+		}
+		t.deadline = now.Add(interval)
+		heap.Push(&s.tasks, t)
+		t.wg.Done()
+	}
+	s.mux.Unlock()
+	s.notify()
+}
@@ -0,0 +1,243 @@
+package turnc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+
+	"gortc.io/turnc/internal/testutil"
+)
+
+func TestRetryInterval(t *testing.T) {
+	for _, tc := range []struct {
+		failures int
+		interval time.Duration
+		retry    time.Duration
+	}{
+		{1, time.Hour, time.Second},
+		{2, time.Hour, time.Second * 2},
+		{3, time.Hour, time.Second * 4},
+		{7, time.Hour, maxRetryInterval},
+		{100, time.Hour, maxRetryInterval},
+		{3, time.Second * 3, time.Second * 3},
+	} {
+		if d := retryInterval(tc.failures, tc.interval); d != tc.retry {
+			t.Errorf("retryInterval(%d, %s) = %s, expected %s",
+				tc.failures, tc.interval, d, tc.retry,
+			)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	t.Run("Backoff", func(t *testing.T) {
+		s := newScheduler()
+		defer s.close()
+		task := &refreshTask{
+			log:  zap.NewNop(),
+			name: "test",
+			interval: func() time.Duration {
+				return time.Hour
+			},
+		}
+		check := func(failures int, interval time.Duration) {
+			t.Helper()
+			s.mux.Lock()
+			defer s.mux.Unlock()
+			if task.failures != failures {
+				t.Errorf("unexpected failures: %d", task.failures)
+			}
+			if d := time.Until(task.deadline); d > interval || d < interval-time.Second {
+				t.Errorf("unexpected interval: %s", d)
+			}
+		}
+		for i, err := range []error{errors.New("failed"), errors.New("failed"), nil} {
+			task.wg.Add(1)
+			s.reschedule([]*refreshTask{task}, []error{err})
+			switch i {
+			case 0:
+				check(1, time.Second)
+			case 1:
+				check(2, time.Second*2)
+			default:
+				check(0, time.Hour)
+			}
+			s.remove(task)
+			task.stopped = false
+		}
+	})
+	t.Run("Remove", func(t *testing.T) {
+		s := newScheduler()
+		defer s.close()
+		var (
+			mux   sync.Mutex
+			count int
+		)
+		refreshed := make(chan struct{}, 1)
+		task := &refreshTask{
+			log:  zap.NewNop(),
+			name: "test",
+			interval: func() time.Duration {
+				return time.Millisecond
+			},
+			refresh: func() error {
+				mux.Lock()
+				count++
+				mux.Unlock()
+				select {
+				case refreshed <- struct{}{}:
+				default:
+				}
+				return nil
+			},
+		}
+		s.add(task)
+		select {
+		case <-refreshed:
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out")
+		}
+		s.remove(task)
+		mux.Lock()
+		removedCount := count
+		mux.Unlock()
+		time.Sleep(time.Millisecond * 20)
+		mux.Lock()
+		defer mux.Unlock()
+		if count != removedCount {
+			t.Error("should not be refreshed after remove")
+		}
+	})
+}
+
+func TestScheduler_CoalescePermissions(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	connL, connR := net.Pipe()
+	defer mustClose(t, connL)
+	stunClient := &testSTUN{}
+	c, createErr := New(Options{
+		Log:         zap.New(core),
+		Conn:        connR, // should not be used
+		STUN:        stunClient,
+		RefreshRate: time.Millisecond * 100,
+	})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+				&turn.RelayedAddress{
+					Port: 1113,
+					IP:   net.IPv4(127, 0, 0, 2),
+				},
+				stun.Fingerprint,
+			),
+		})
+		return nil
+	}
+	a, allocErr := c.Allocate()
+	if allocErr != nil {
+		t.Fatal(allocErr)
+	}
+	coalesced := make(chan struct{}, 1)
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		var peers int
+		for _, attr := range m.Attributes {
+			if attr.Type == stun.AttrXORPeerAddress {
+				peers++
+			}
+		}
+		if peers > 1 {
+			select {
+			case coalesced <- struct{}{}:
+			default:
+			}
+		}
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+				stun.Fingerprint,
+			),
+		})
+		return nil
+	}
+	var perms []*Permission
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 3), net.IPv4(127, 0, 0, 4)} {
+		p, err := a.Create(ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		perms = append(perms, p)
+	}
+	select {
+	case <-coalesced:
+	case <-time.After(time.Second * 5):
+		t.Fatal("permission refreshes not coalesced")
+	}
+	for _, p := range perms {
+		if err := p.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+	testutil.EnsureNoErrors(t, logs)
+}
+
+func TestRefreshGroup(t *testing.T) {
+	_, stunClient, a := newTestAllocation(t, Options{})
+	var group []*refreshTask
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 3), net.IPv4(127, 0, 0, 4)} {
+		p, err := a.Create(ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		group = append(group, &refreshTask{log: p.log, name: "permission", perm: p})
+	}
+	forbidden := net.IPv4(127, 0, 0, 4)
+	var requests int
+	stunClient.do = func(m *stun.Message, f func(e stun.Event)) error {
+		requests++
+		var peers int
+		for _, attr := range m.Attributes {
+			if attr.Type == stun.AttrXORPeerAddress {
+				peers++
+			}
+		}
+		var peer turn.PeerAddress
+		if err := peer.GetFrom(m); err != nil {
+			t.Error(err)
+		}
+		if peers > 1 || peer.IP.Equal(forbidden) {
+			f(stun.Event{
+				Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+					stun.CodeForbidden, stun.Fingerprint,
+				),
+			})
+			return nil
+		}
+		f(stun.Event{
+			Message: stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+				stun.Fingerprint,
+			),
+		})
+		return nil
+	}
+	errs := refreshGroup(group)
+	if requests != 3 {
+		t.Errorf("unexpected requests: %d", requests)
+	}
+	if errs[0] != nil {
+		t.Errorf("unexpected error: %v", errs[0])
+	}
+	if !errors.Is(errs[1], ErrForbidden) {
+		t.Errorf("unexpected error: %v", errs[1])
+	}
+}
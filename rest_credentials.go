@@ -0,0 +1,51 @@
+package turnc
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"time"
+)
+
+// DefaultRESTCredentialsTTL is default lifetime of TURN REST API
+// credentials.
+const DefaultRESTCredentialsTTL = 24 * time.Hour
+
+// NewRESTCredentials returns ephemeral credentials of TURN REST API
+// ("use-auth-secret" in coturn) that are valid until expires.
+//
+// Username is "expiry:user" with expiry as unix timestamp, or just
+// timestamp for empty user, and password is base64-encoded HMAC-SHA1 of
+// username keyed by shared secret.
+func NewRESTCredentials(secret, user string, expires time.Time) Credentials {
+	username := strconv.FormatInt(expires.Unix(), 10)
+	if user != "" {
+		username += ":" + user
+	}
+	mac := hmac.New(sha1.New, []byte(secret))
+	_, _ = mac.Write([]byte(username)) // hash.Hash never returns error
+	return Credentials{
+		Username: username,
+		Password: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+		Expires:  expires,
+	}
+}
+
+// RESTCredentials returns CredentialProvider for TURN REST API shared
+// secret, generating credentials that are valid for ttl
+// (DefaultRESTCredentialsTTL if zero) on each request.
+//
+// Username can't be changed during allocation (RFC 5766 Section 4), so
+// allocation is refreshed with credentials it was created with until they
+// expire. With Options.Recover, allocation is created again with new
+// credentials before expiration, otherwise requests fail with
+// ErrUsernameChanged after it.
+func RESTCredentials(secret, user string, ttl time.Duration) CredentialProvider {
+	if ttl <= 0 {
+		ttl = DefaultRESTCredentialsTTL
+	}
+	return CredentialProviderFunc(func(realm string) (Credentials, error) {
+		return NewRESTCredentials(secret, user, time.Now().Add(ttl)), nil
+	})
+}
@@ -0,0 +1,48 @@
+package turnc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewRESTCredentials(t *testing.T) {
+	expires := time.Unix(1700000000, 0)
+	for _, tc := range []struct {
+		name     string
+		user     string
+		username string
+	}{
+		{name: "User", user: "alice", username: "1700000000:alice"},
+		{name: "NoUser", username: "1700000000"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewRESTCredentials("north", tc.user, expires)
+			if c.Username != tc.username {
+				t.Errorf("unexpected username: %q", c.Username)
+			}
+			if !c.Expires.Equal(expires) {
+				t.Errorf("unexpected expiration: %s", c.Expires)
+			}
+		})
+	}
+	// Password is checked against value generated by reference
+	// implementation.
+	c := NewRESTCredentials("north", "alice", expires)
+	if c.Password != "Cd/49soE35ICqcJF/bCTn8Z4OyE=" {
+		t.Errorf("unexpected password: %q", c.Password)
+	}
+}
+
+func TestRESTCredentials(t *testing.T) {
+	start := time.Now()
+	c, err := RESTCredentials("north", "alice", 0).Credentials("realm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Expires.Before(start.Add(DefaultRESTCredentialsTTL)) {
+		t.Errorf("unexpected expiration: %s", c.Expires)
+	}
+	if c != NewRESTCredentials("north", "alice", c.Expires) {
+		t.Error("credentials mismatch")
+	}
+}
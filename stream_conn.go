@@ -0,0 +1,101 @@
+package turnc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"gortc.io/turn"
+)
+
+const (
+	stunHeaderSize        = 20
+	channelDataHeaderSize = 4
+	channelDataPadding    = 4
+)
+
+// ErrUnexpectedStreamData means that stream contains data that is neither
+// STUN message nor ChannelData message, so framing can't be recovered.
+var ErrUnexpectedStreamData = errors.New("unexpected data in stream")
+
+// streamConn wraps stream-oriented connection (like TCP or TLS) and
+// provides datagram-like semantics over it, as described in
+// RFC 5766 Section 2.1.
+//
+// Each Read returns exactly one STUN or ChannelData message, truncated
+// to len(b) like UDP does, and each ChannelData message is padded to
+// the multiple of 4 bytes on Write (RFC 5766 Section 11.5).
+type streamConn struct {
+	net.Conn
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newStreamConn(conn net.Conn) *streamConn {
+	return &streamConn{
+		Conn: conn,
+		r:    bufio.NewReaderSize(conn, packetSize),
+	}
+}
+
+func paddedLength(l int) int {
+	if rem := l % channelDataPadding; rem != 0 {
+		return l + channelDataPadding - rem
+	}
+	return l
+}
+
+// frameLength returns message length and length of message with padding
+// for the message which header is provided.
+func frameLength(header []byte) (length, padded int, err error) {
+	length = int(binary.BigEndian.Uint16(header[2:4]))
+	switch header[0] >> 6 {
+	case 0:
+		// STUN message, always aligned to 4 bytes.
+		length += stunHeaderSize
+		return length, length, nil
+	case 1:
+		// ChannelData message.
+		length += channelDataHeaderSize
+		return length, paddedLength(length), nil
+	default:
+		return 0, 0, ErrUnexpectedStreamData
+	}
+}
+
+// Read reads exactly one message from stream to b.
+func (c *streamConn) Read(b []byte) (int, error) {
+	header, err := c.r.Peek(channelDataHeaderSize)
+	if err != nil {
+		return 0, err
+	}
+	length, padded, err := frameLength(header)
+	if err != nil {
+		return 0, err
+	}
+	if cap(c.buf) < padded {
+		c.buf = make([]byte, padded)
+	}
+	c.buf = c.buf[:padded]
+	if _, err = io.ReadFull(c.r, c.buf); err != nil {
+		return 0, err
+	}
+	return copy(b, c.buf[:length]), nil
+}
+
+// Write writes b to stream, padding ChannelData message if needed.
+func (c *streamConn) Write(b []byte) (int, error) {
+	if !turn.IsChannelData(b) || len(b)%channelDataPadding == 0 {
+		return c.Conn.Write(b)
+	}
+	// Writing padded message in one call, so concurrent writes
+	// can't interleave with padding.
+	buf := make([]byte, paddedLength(len(b)))
+	copy(buf, b)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
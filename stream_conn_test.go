@@ -0,0 +1,232 @@
+package turnc
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+	"gortc.io/turnc/internal/testutil"
+)
+
+func TestStreamConn(t *testing.T) {
+	t.Run("Read", func(t *testing.T) {
+		connL, connR := net.Pipe()
+		defer mustClose(t, connL)
+		c := newStreamConn(connR)
+		m := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+		d := &turn.ChannelData{
+			Number: turn.MinChannelNumber,
+			Data:   []byte{1, 2, 3, 4, 5},
+		}
+		d.Encode()
+		raw := d.Raw[:channelDataHeaderSize+len(d.Data)]
+		var stream []byte
+		stream = append(stream, m.Raw...)
+		stream = append(stream, raw...)
+		stream = append(stream, make([]byte, paddedLength(len(raw))-len(raw))...)
+		stream = append(stream, m.Raw...)
+		go func() {
+			// Writing stream in small chunks to check re-assembling.
+			for len(stream) > 0 {
+				n := 7
+				if n > len(stream) {
+					n = len(stream)
+				}
+				if _, err := connL.Write(stream[:n]); err != nil {
+					t.Error(err)
+					return
+				}
+				stream = stream[n:]
+			}
+		}()
+		buf := make([]byte, 1500)
+		for i, expected := range [][]byte{m.Raw, raw, m.Raw} {
+			n, err := c.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], expected) {
+				t.Errorf("%d: unexpected message %v", i, buf[:n])
+			}
+		}
+	})
+	t.Run("ReadUnexpected", func(t *testing.T) {
+		connL, connR := net.Pipe()
+		defer mustClose(t, connL)
+		c := newStreamConn(connR)
+		go func() {
+			if _, err := connL.Write([]byte{0xff, 1, 2, 3}); err != nil {
+				t.Error(err)
+			}
+		}()
+		if _, err := c.Read(make([]byte, 1500)); err != ErrUnexpectedStreamData {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("ReadEOF", func(t *testing.T) {
+		connL, connR := net.Pipe()
+		c := newStreamConn(connR)
+		go func() {
+			if _, err := connL.Write([]byte{0x40, 0x00, 0x00, 0x10, 1, 2}); err != nil {
+				t.Error(err)
+			}
+			mustClose(t, connL)
+		}()
+		if _, err := c.Read(make([]byte, 1500)); err != io.ErrUnexpectedEOF {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("WritePadding", func(t *testing.T) {
+		connL, connR := net.Pipe()
+		defer mustClose(t, connL)
+		c := newStreamConn(connR)
+		d := &turn.ChannelData{
+			Number: turn.MinChannelNumber,
+			Data:   []byte{1, 2, 3, 4, 5},
+		}
+		d.Encode()
+		raw := d.Raw[:channelDataHeaderSize+len(d.Data)]
+		go func() {
+			n, err := c.Write(raw)
+			if err != nil {
+				t.Error(err)
+			}
+			if n != len(raw) {
+				t.Errorf("unexpected n: %d", n)
+			}
+		}()
+		buf := make([]byte, 1500)
+		n, err := io.ReadAtLeast(connL, buf, 12)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 12 {
+			t.Errorf("unexpected padded length %d", n)
+		}
+		if !bytes.Equal(buf[:len(raw)], raw) {
+			t.Error("data mismatch")
+		}
+	})
+}
+
+// serveStream is serveEcho over stream connection.
+func serveStream(t *testing.T, conn net.Conn) {
+	t.Helper()
+	serveEcho(t, newStreamConn(conn))
+}
+
+// serveEcho is minimal TURN server that responds with success to
+// any request and echoes back any ChannelData message.
+func serveEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer mustClose(t, conn)
+	buf := make([]byte, 1500)
+	for {
+		n, readErr := conn.Read(buf)
+		if readErr != nil {
+			return
+		}
+		if turn.IsChannelData(buf[:n]) {
+			// Echoing back channel data.
+			if _, writeErr := conn.Write(buf[:n]); writeErr != nil {
+				t.Error(writeErr)
+			}
+			continue
+		}
+		m := &stun.Message{Raw: buf[:n]}
+		if decodeErr := m.Decode(); decodeErr != nil {
+			t.Error(decodeErr)
+			return
+		}
+		res := stun.MustBuild(m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse),
+			&turn.RelayedAddress{
+				IP:   net.IPv4(127, 0, 0, 1),
+				Port: 1001,
+			},
+			stun.Fingerprint,
+		)
+		if _, writeErr := conn.Write(res.Raw); writeErr != nil {
+			t.Error(writeErr)
+		}
+	}
+}
+
+// checkEcho allocates, binds channel to peer and checks that data is
+// echoed back by serveStream.
+func checkEcho(t *testing.T, c *Client, timeout time.Duration) {
+	t.Helper()
+	a, allocErr := c.Allocate()
+	if allocErr != nil {
+		t.Fatal(allocErr)
+	}
+	peer := &net.UDPAddr{
+		IP:   net.IPv4(127, 0, 0, 3),
+		Port: 1003,
+	}
+	p, permErr := a.Create(peer.IP)
+	if permErr != nil {
+		t.Fatal(permErr)
+	}
+	peerConn, err := p.CreateUDP(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bindErr := peerConn.Bind(); bindErr != nil {
+		t.Fatal(bindErr)
+	}
+	sent := []byte{1, 2, 3, 4, 5}
+	if _, writeErr := peerConn.Write(sent); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	buf := make([]byte, 1500)
+	_ = peerConn.SetReadDeadline(time.Now().Add(timeout))
+	n, readErr := peerConn.Read(buf)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if !bytes.Equal(buf[:n], sent) {
+		t.Error("data mismatch")
+	}
+}
+
+func TestClientStream(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mustClose(t, ln)
+	timeout := time.Second * 10
+	go func() {
+		conn, acceptErr := ln.Accept()
+		if acceptErr != nil {
+			t.Error(acceptErr)
+			return
+		}
+		serveStream(t, conn)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, createErr := New(Options{
+		Log:          zap.New(core),
+		Conn:         conn,
+		RTO:          timeout,
+		NoRetransmit: true,
+	})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	checkEcho(t, c, timeout)
+	testutil.EnsureNoErrors(t, logs)
+	mustClose(t, c)
+}